@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Backend describes a protocol implementation selectable through the
+// protocol field of a connection.
+type Backend struct {
+	// Validate checks the protocol specific fields of a connection.
+	Validate func(conn Connection) error
+	// New returns an unconnected Manager for the protocol.
+	New func() Manager
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{}
+)
+
+// registerBackend makes a protocol available to readConfig and
+// handleConnection. It panics if the protocol is registered twice.
+func registerBackend(protocol string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if protocol == "" || backend.New == nil {
+		panic("registerBackend: protocol name and factory are required")
+	}
+	if _, exists := backends[protocol]; exists {
+		panic(fmt.Sprintf("registerBackend: protocol %s registered twice", protocol))
+	}
+	backends[protocol] = backend
+}
+
+func lookupBackend(protocol string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	backend, ok := backends[protocol]
+	return backend, ok
+}
+
+// registeredProtocols returns the sorted names of all registered protocols.
+func registeredProtocols() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	protocols := make([]string, 0, len(backends))
+	for protocol := range backends {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	return protocols
+}
+
+// validateServer checks the fields shared by all backends that log in to a
+// remote server.
+func validateServer(conn Connection) error {
+	if conn.Host == "" {
+		return fmt.Errorf("connection host is missing for %s", conn.Name)
+	}
+	if conn.Port <= 0 || conn.Port > 65535 {
+		return fmt.Errorf("invalid port number for %s: %d", conn.Name, conn.Port)
+	}
+	if conn.Username == "" {
+		return fmt.Errorf("username is missing for %s", conn.Name)
+	}
+	return nil
+}
+
+// validateFTP checks connections that log in with a username and password.
+func validateFTP(conn Connection) error {
+	if err := validateServer(conn); err != nil {
+		return err
+	}
+	if conn.Password == "" {
+		return fmt.Errorf("password is missing for %s", conn.Name)
+	}
+	return nil
+}
+
+// validateFTPoverSSH checks both the SSH tunnel and the FTP login, which
+// falls back to the SSH credentials.
+func validateFTPoverSSH(conn Connection) error {
+	if err := validateSSH(conn); err != nil {
+		return err
+	}
+	if conn.FTPPort < 0 || conn.FTPPort > 65535 {
+		return fmt.Errorf("invalid ftp_port for %s: %d", conn.Name, conn.FTPPort)
+	}
+	if _, _, _, password := ftpOverSSHTarget(conn); password == "" {
+		return fmt.Errorf("ftp_password is missing for %s", conn.Name)
+	}
+	return nil
+}
+
+func validateFTPS(conn Connection) error {
+	if err := validateFTP(conn); err != nil {
+		return err
+	}
+	return validateTLS(conn)
+}
+
+func init() {
+	registerBackend("sftp", Backend{
+		Validate: validateSSH,
+		New:      func() Manager { return &ManagerSFTP{} },
+	})
+	registerBackend("ftp", Backend{
+		Validate: validateFTP,
+		New:      func() Manager { return &ManagerFTP{} },
+	})
+	registerBackend("ftps", Backend{
+		Validate: validateFTPS,
+		New:      func() Manager { return &ManagerFTP{tlsMode: ftpTLSExplicit} },
+	})
+	registerBackend("ftps-implicit", Backend{
+		Validate: validateFTPS,
+		New:      func() Manager { return &ManagerFTP{tlsMode: ftpTLSImplicit} },
+	})
+	registerBackend("ftpoverssh", Backend{
+		Validate: validateFTPoverSSH,
+		New:      func() Manager { return &ManagerFTPoverSSH{} },
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeManager serves an in-memory tree of files keyed by remote path.
+type fakeManager struct {
+	files   map[string][]byte
+	deleted []string
+}
+
+func (fm *fakeManager) connect(conn Connection) error { return nil }
+
+func (fm *fakeManager) readDir(remotePath string) ([]RemoteEntry, error) {
+	seen := map[string]bool{}
+	var entries []RemoteEntry
+	for name, data := range fm.files {
+		rel := strings.TrimPrefix(name, remotePath+"/")
+		if rel == name {
+			continue
+		}
+		parts := strings.SplitN(rel, "/", 2)
+		if seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		if len(parts) == 2 {
+			entries = append(entries, RemoteEntry{Name: parts[0], Kind: EntryFolder, Mode: os.ModeDir})
+		} else {
+			entries = append(entries, RemoteEntry{Name: parts[0], Kind: EntryFile, Size: int64(len(data)), ModTime: time.Now()})
+		}
+	}
+	return entries, nil
+}
+
+func (fm *fakeManager) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	data, ok := fm.files[remotePath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (fm *fakeManager) deleteFile(remotePath string) error {
+	delete(fm.files, remotePath)
+	fm.deleted = append(fm.deleted, remotePath)
+	return nil
+}
+
+func (fm *fakeManager) close() error { return nil }
+
+// setupTestDB points the global database at a fresh file in a temp directory.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	conn, err := openDatabaseAt(filepath.Join(t.TempDir(), "downloads.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := createTable(conn); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	db.conn = conn
+	t.Cleanup(func() { conn.Close() })
+}
+
+// registerTestBackend registers a backend for the duration of a test.
+func registerTestBackend(t *testing.T, protocol string, backend Backend) {
+	t.Helper()
+	registerBackend(protocol, backend)
+	t.Cleanup(func() {
+		backendsMu.Lock()
+		defer backendsMu.Unlock()
+		delete(backends, protocol)
+	})
+}
+
+func TestRegisteredBackendDownload(t *testing.T) {
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/a.txt":     []byte("alpha"),
+		"/in/sub/b.txt": []byte("bravo"),
+		"/in/c.log":     []byte("charlie"),
+	}}
+	registerTestBackend(t, "fake-download", Backend{New: func() Manager { return fm }})
+
+	yamlContent := `
+connections:
+  - name: "fake"
+    protocol: "fake-download"
+    path: "/in"
+    depth: 2
+    regex: "\\.txt$"
+    remove: true
+`
+	configPath := filepath.Join(t.TempDir(), "connections.yaml")
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	config, err := readConfig(configPath)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+
+	backend, ok := lookupBackend("fake-download")
+	if !ok {
+		t.Fatalf("Backend was not registered")
+	}
+	handleDownload(config.Connections[0], backend.New())
+
+	for name, want := range map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"} {
+		data, err := os.ReadFile(path.Join(download_folder, name))
+		if err != nil {
+			t.Errorf("Expected %s to be downloaded: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("Unexpected content for %s: %q", name, data)
+		}
+	}
+	if _, err := os.Stat(path.Join(download_folder, "c.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected c.log to be filtered out by regex")
+	}
+	if len(fm.deleted) != 2 {
+		t.Errorf("Expected 2 remote files to be removed, got %v", fm.deleted)
+	}
+
+	entries, err := searchDownloadedFileEntries(db.conn, "a.txt", 5, "fake")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected a.txt to be recorded once, got %v (err: %v)", entries, err)
+	}
+}
+
+func TestReadConfigUnsupportedProtocol(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "connections.yaml")
+	yamlContent := `
+connections:
+  - name: "unknown"
+    protocol: "gopher"
+    path: "/"
+`
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := readConfig(configPath); err == nil || !strings.Contains(err.Error(), "unsupported protocol") {
+		t.Errorf("Expected unsupported protocol error, got %v", err)
+	}
+}
+
+// kindManager adds a link and a special entry to every fakeManager listing.
+type kindManager struct {
+	fakeManager
+}
+
+func (fm *kindManager) readDir(remotePath string) ([]RemoteEntry, error) {
+	entries, err := fm.fakeManager.readDir(remotePath)
+	entries = append(entries,
+		RemoteEntry{Name: "link.txt", Kind: EntryLink, Mode: os.ModeSymlink},
+		RemoteEntry{Name: "fifo", Kind: EntryOther, Mode: os.ModeNamedPipe})
+	return entries, err
+}
+
+func TestRecursivelyDownloadDepthAndKinds(t *testing.T) {
+	fm := &kindManager{fakeManager{files: map[string][]byte{
+		"/in/top.txt":         []byte("top"),
+		"/in/a/mid.txt":       []byte("mid"),
+		"/in/a/b/deep.txt":    []byte("deep"),
+		"/in/a/b/c/too_deep":  []byte("deeper"),
+		"/in/other/other.txt": []byte("other"),
+	}}}
+	conn := Connection{Name: "recursive", Path: "/in", Depth: 3}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	if err := recursivelyDownload(conn.Path, download_folder, conn.Depth, fm, conn); err != nil {
+		t.Fatalf("recursivelyDownload failed: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"top.txt":         "top",
+		"a/mid.txt":       "mid",
+		"a/b/deep.txt":    "deep",
+		"other/other.txt": "other",
+	} {
+		data, err := os.ReadFile(filepath.Join(download_folder, name))
+		if err != nil || string(data) != want {
+			t.Errorf("Unexpected content for %s: %q (err: %v)", name, data, err)
+		}
+	}
+	// Depth 3 lists /in, /in/a and /in/a/b but not /in/a/b/c, and links and
+	// special entries are skipped at every level
+	for _, name := range []string{"a/b/c/too_deep", "link.txt", "fifo", "a/link.txt"} {
+		if _, err := os.Stat(filepath.Join(download_folder, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s not to be downloaded", name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// checksumAlgorithm describes how a checksum is computed locally and how it
+// is asked for from servers.
+type checksumAlgorithm struct {
+	hashName   string // name in the FTP HASH extension
+	ftpCommand string // legacy FTP command, e.g. XMD5
+	sumCommand string // command run over SSH
+	hexLen     int
+	new        func() hash.Hash
+}
+
+var checksumAlgorithms = map[string]checksumAlgorithm{
+	"sha256": {"SHA-256", "XSHA256", "sha256sum", 64, sha256.New},
+	"md5":    {"MD5", "XMD5", "md5sum", 32, md5.New},
+	"crc32":  {"CRC32", "XCRC", "", 8, func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// Where the expected checksum of a remote file comes from.
+const (
+	checksumAuto    = "auto"    // server when supported, otherwise sidecar
+	checksumServer  = "server"  // SSH exec or FTP HASH/XMD5/XCRC
+	checksumSidecar = "sidecar" // <file>.<algorithm> next to the source
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// hasher is implemented by backends that can compute a checksum of a remote
+// file on the server.
+type hasher interface {
+	remoteChecksum(remotePath, algorithm string) (string, error)
+}
+
+// fileChecksum is the checksum of a downloaded file. Verified is set when it
+// matched the checksum of the remote file.
+type fileChecksum struct {
+	Algorithm string
+	Value     string
+	Verified  bool
+}
+
+// String formats the checksum as stored in the database, e.g. sha256:ab12...
+func (c fileChecksum) String() string {
+	if c.Value == "" {
+		return ""
+	}
+	return c.Algorithm + ":" + c.Value
+}
+
+func validateChecksum(conn Connection) error {
+	if conn.Checksum == "" {
+		if conn.ChecksumSource != "" {
+			return fmt.Errorf("checksum_source requires checksum for %s", conn.Name)
+		}
+		return nil
+	}
+	if _, ok := checksumAlgorithms[conn.Checksum]; !ok {
+		return fmt.Errorf("invalid checksum for %s: %s (supported: sha256, md5, crc32)", conn.Name, conn.Checksum)
+	}
+	switch conn.ChecksumSource {
+	case "", checksumAuto, checksumServer, checksumSidecar:
+	default:
+		return fmt.Errorf("invalid checksum_source for %s: %s", conn.Name, conn.ChecksumSource)
+	}
+	return nil
+}
+
+// isChecksumSidecar reports whether name is a sidecar checksum file that is
+// consumed by verification rather than downloaded itself, which is the case
+// unless only server checksums are used.
+func isChecksumSidecar(conn Connection, name string) bool {
+	return conn.Checksum != "" && conn.ChecksumSource != checksumServer && strings.HasSuffix(name, "."+conn.Checksum)
+}
+
+// finishSidecar applies the post action of a verified data file to its
+// sidecar, which would otherwise stay behind on the server. dir is the
+// listing of the data file's folder.
+func finishSidecar(fm Manager, conn Connection, file RemoteEntry, remoteFilePath string, dir []RemoteEntry, sum fileChecksum) {
+	if !sum.Verified || !isChecksumSidecar(conn, file.Name+"."+conn.Checksum) {
+		return
+	}
+	if _, ok := findEntry(dir, file.Name+"."+conn.Checksum); !ok {
+		return
+	}
+	applyPostAction(fm, conn, remoteFilePath+"."+conn.Checksum, time.Now())
+}
+
+// verifyChecksum compares the checksum of localPath with the one of the
+// remote file. When the remote side offers no checksum the local one is
+// still returned, unverified.
+func verifyChecksum(fm Manager, conn Connection, remoteFilePath, localPath string) (fileChecksum, error) {
+	sum := fileChecksum{Algorithm: conn.Checksum}
+	if conn.Checksum == "" {
+		return sum, nil
+	}
+	alg := checksumAlgorithms[conn.Checksum]
+
+	local, err := localChecksum(localPath, alg)
+	if err != nil {
+		return sum, fmt.Errorf("error computing checksum: %v", err)
+	}
+	sum.Value = local
+
+	expected, err := expectedChecksum(fm, conn, remoteFilePath, alg)
+	if err != nil {
+		logger.Warnf("No %s checksum available for %s: %v\n", conn.Checksum, remoteFilePath, err)
+		return sum, nil
+	}
+	if !strings.EqualFold(expected, local) {
+		return sum, fmt.Errorf("%w for %s: expected %s, got %s", errChecksumMismatch, remoteFilePath, expected, local)
+	}
+	logger.Debugf("Checksum verified for %s: %s\n", remoteFilePath, sum)
+	sum.Verified = true
+	return sum, nil
+}
+
+func expectedChecksum(fm Manager, conn Connection, remoteFilePath string, alg checksumAlgorithm) (string, error) {
+	var serverErr error
+	if conn.ChecksumSource != checksumSidecar {
+		h, ok := fm.(hasher)
+		if !ok {
+			serverErr = errors.New("backend cannot compute checksums")
+		} else {
+			sum, err := h.remoteChecksum(remoteFilePath, conn.Checksum)
+			if err == nil {
+				return sum, nil
+			}
+			serverErr = err
+		}
+		if conn.ChecksumSource == checksumServer {
+			return "", serverErr
+		}
+		logger.Debugf("Server checksum unavailable for %s, trying sidecar: %v\n", remoteFilePath, serverErr)
+	}
+	return sidecarChecksum(fm, remoteFilePath+"."+conn.Checksum, alg)
+}
+
+// sidecarChecksum reads a checksum file in the format of sha256sum and
+// md5sum, or one holding just the checksum.
+func sidecarChecksum(fm Manager, sidecarPath string, alg checksumAlgorithm) (string, error) {
+	rc, err := fm.openFile(sidecarPath, 0)
+	if err != nil {
+		return "", fmt.Errorf("error opening sidecar %s: %v", sidecarPath, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("error reading sidecar %s: %v", sidecarPath, err)
+	}
+	sum := findChecksum(string(data), alg.hexLen)
+	if sum == "" {
+		return "", fmt.Errorf("no checksum found in sidecar %s", sidecarPath)
+	}
+	return sum, nil
+}
+
+// findChecksum returns the first field of text that looks like a checksum
+// of hexLen hex digits. Server replies put it in varying positions.
+func findChecksum(text string, hexLen int) string {
+	for _, field := range strings.Fields(text) {
+		if len(field) != hexLen {
+			continue
+		}
+		if _, err := hex.DecodeString(field); err == nil {
+			return strings.ToLower(field)
+		}
+	}
+	return ""
+}
+
+func localChecksum(localPath string, alg checksumAlgorithm) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := alg.new()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumFromFTPServer(t *testing.T) {
+	content := []byte("checksummed payload\n")
+	md5Sum := md5.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+
+	for _, tc := range []struct {
+		algorithm string
+		disable   string
+		want      string
+		command   string
+	}{
+		{"sha256", "", hex.EncodeToString(sha256Sum[:]), "HASH"},
+		{"md5", "HASH", hex.EncodeToString(md5Sum[:]), "XMD5"},
+		{"crc32", "HASH", fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), "XCRC"},
+	} {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(root, "data.bin"), content, 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			srv := startTestFTPServer(t, root, nil, false)
+			if tc.disable != "" {
+				srv.disable(tc.disable)
+			}
+			setupTestDB(t)
+			download_folder = t.TempDir()
+
+			conn := Connection{
+				Name: "ftp_sum", Host: "127.0.0.1", Port: srv.port(), Protocol: "ftp",
+				Username: "user", Password: "pass", Path: "/", Depth: 1, Remove: true,
+				Checksum: tc.algorithm,
+			}
+			handleDownload(conn, &ManagerFTP{})
+
+			if !srv.received(tc.command) {
+				t.Errorf("Expected checksum to be requested with %s", tc.command)
+			}
+			files, err := searchDownloadedFileEntries(db.conn, "data.bin", int64(len(content)), "ftp_sum")
+			if err != nil || len(files) != 1 || files[0].Checksum != tc.algorithm+":"+tc.want {
+				t.Fatalf("Expected checksum %s:%s to be recorded, got %+v (err: %v)", tc.algorithm, tc.want, files, err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "data.bin")); !os.IsNotExist(err) {
+				t.Errorf("Expected verified file to be removed from the server")
+			}
+		})
+	}
+}
+
+func TestChecksumFromSSHExec(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("over ssh\n")
+	if err := os.WriteFile(filepath.Join(root, "data.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	srv := newTestSSHServer(t, root)
+	srv.start(t)
+	setupTestDB(t)
+	download_folder = t.TempDir()
+
+	conn := Connection{
+		Name: "sftp_sum", Host: "127.0.0.1", Port: srv.port(), Protocol: "sftp",
+		Username: "user", Password: "pass", Path: ".", Depth: 1,
+		Checksum: "sha256", ChecksumSource: checksumServer,
+	}
+	handleDownload(conn, &ManagerSFTP{})
+
+	sum := sha256.Sum256(content)
+	files, err := searchDownloadedFileEntries(db.conn, "data.bin", int64(len(content)), "sftp_sum")
+	if err != nil || len(files) != 1 || files[0].Checksum != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected verified sha256 to be recorded, got %+v (err: %v)", files, err)
+	}
+}
+
+func TestChecksumSidecar(t *testing.T) {
+	content := []byte("sidecar\n")
+	sum := sha256.Sum256(content)
+
+	for _, tc := range []struct {
+		name      string
+		sidecar   string
+		delivered bool
+		removed   bool
+	}{
+		{"match", hex.EncodeToString(sum[:]) + "  data.bin\n", true, true},
+		{"mismatch", strings.Repeat("0", 64) + "  data.bin\n", false, false},
+		{"missing", "", true, false},
+	} {
+		// Local sources have no server checksums, so auto reads the sidecar
+		for _, source := range []string{checksumSidecar, checksumAuto} {
+			t.Run(tc.name+" "+source, func(t *testing.T) {
+				root := t.TempDir()
+				if err := os.WriteFile(filepath.Join(root, "data.bin"), content, 0644); err != nil {
+					t.Fatalf("Failed to write file: %v", err)
+				}
+				if tc.sidecar != "" {
+					if err := os.WriteFile(filepath.Join(root, "data.bin.sha256"), []byte(tc.sidecar), 0644); err != nil {
+						t.Fatalf("Failed to write sidecar: %v", err)
+					}
+				}
+				setupTestDB(t)
+				download_folder = t.TempDir()
+
+				conn := Connection{Name: "local_sum", Protocol: "local", Path: root, Depth: 1, Remove: true, Checksum: "sha256", ChecksumSource: source}
+				handleDownload(conn, &ManagerLocal{})
+
+				_, err := os.Stat(filepath.Join(download_folder, "data.bin"))
+				if delivered := err == nil; delivered != tc.delivered {
+					t.Errorf("Expected delivered=%v, got %v", tc.delivered, delivered)
+				}
+				if _, err := os.Stat(filepath.Join(download_folder, "data.bin.sha256")); !os.IsNotExist(err) {
+					t.Errorf("Expected the sidecar not to be downloaded itself")
+				}
+				// Remove only applies once the checksum matched, and then to
+				// the sidecar as well
+				_, err = os.Stat(filepath.Join(root, "data.bin"))
+				if removed := os.IsNotExist(err); removed != tc.removed {
+					t.Errorf("Expected removed=%v, got %v", tc.removed, removed)
+				}
+				_, err = os.Stat(filepath.Join(root, "data.bin.sha256"))
+				if kept := err == nil; kept != (tc.sidecar != "" && !tc.removed) {
+					t.Errorf("Expected the sidecar to share the fate of its data file, kept=%v", kept)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateChecksum(t *testing.T) {
+	if err := validateChecksum(Connection{Name: "c", Checksum: "sha1"}); err == nil {
+		t.Errorf("Expected error for unsupported algorithm")
+	}
+	if err := validateChecksum(Connection{Name: "c", Checksum: "md5", ChecksumSource: "remote"}); err == nil {
+		t.Errorf("Expected error for unknown checksum source")
+	}
+	if err := validateChecksum(Connection{Name: "c", ChecksumSource: checksumSidecar}); err == nil {
+		t.Errorf("Expected error for checksum_source without checksum")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // Import for side-effects
 )
@@ -12,10 +13,49 @@ type DownloadedFile struct {
 	FileSize     int64
 	ServerName   string
 	DownloadTime string
+	Direction    string
+	Checksum     string
+
+	// Remote action applied after the transfer, e.g. "archive" or
+	// "delete failed", and the new remote path of moved files
+	PostAction     string
+	PostActionPath string
+
+	// Marker is "pending" while the marker_action of the file's marker is
+	// still to be applied, and the applied action afterwards
+	Marker string
+}
+
+// Transfer directions stored in the direction column of downloaded_files.
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+	directionRelay    = "relay"
+)
+
+// ConnectionError is the last security relevant failure of a connection,
+// such as a changed host key.
+type ConnectionError struct {
+	ServerName string
+	Error      string
+	ErrorTime  string
+}
+
+// RouteDelivery records that a file of a route reached one destination.
+type RouteDelivery struct {
+	RouteName    string
+	Destination  string
+	FileName     string
+	FileSize     int64
+	DeliveryTime string
 }
 
 func openDatabase() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./downloads.db")
+	return openDatabaseAt("./downloads.db")
+}
+
+func openDatabaseAt(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %v", err)
 	}
@@ -28,27 +68,136 @@ func createTable(db *sql.DB) error {
 		"file_name" TEXT,
 		"server_name" TEXT,
 		"file_size" INTEGER,
-		"download_time" TEXT
+		"download_time" TEXT,
+		"direction" TEXT NOT NULL DEFAULT 'download',
+		"checksum" TEXT NOT NULL DEFAULT '',
+		"post_action" TEXT NOT NULL DEFAULT '',
+		"post_action_path" TEXT NOT NULL DEFAULT '',
+		"marker" TEXT NOT NULL DEFAULT ''
 	);`
 	_, err := db.Exec(createTableSQL)
 	if err != nil {
 		return fmt.Errorf("error creating table: %v", err)
 	}
+
+	createRouteTableSQL := `CREATE TABLE IF NOT EXISTS route_deliveries (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"route_name" TEXT,
+		"destination" TEXT,
+		"file_name" TEXT,
+		"file_size" INTEGER,
+		"delivery_time" TEXT
+	);`
+	_, err = db.Exec(createRouteTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating route table: %v", err)
+	}
+
+	createErrorTableSQL := `CREATE TABLE IF NOT EXISTS connection_errors (
+		"server_name" TEXT NOT NULL PRIMARY KEY,
+		"error" TEXT,
+		"error_time" TEXT
+	);`
+	_, err = db.Exec(createErrorTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating connection error table: %v", err)
+	}
+
+	createPendingTableSQL := `CREATE TABLE IF NOT EXISTS pending_files (
+		"server_name" TEXT NOT NULL,
+		"file_path" TEXT NOT NULL,
+		"file_size" INTEGER,
+		"mod_time" TEXT,
+		"first_seen" TEXT,
+		"last_seen" TEXT,
+		"listings" INTEGER,
+		PRIMARY KEY (server_name, file_path)
+	);`
+	_, err = db.Exec(createPendingTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating pending file table: %v", err)
+	}
+
+	createRunTableSQL := `CREATE TABLE IF NOT EXISTS connection_runs (
+		"server_name" TEXT NOT NULL PRIMARY KEY,
+		"last_run" TEXT
+	);`
+	_, err = db.Exec(createRunTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating connection run table: %v", err)
+	}
+	if err := addMissingColumn(db, "downloaded_files", "direction", `TEXT NOT NULL DEFAULT 'download'`); err != nil {
+		return err
+	}
+	if err := addMissingColumn(db, "downloaded_files", "checksum", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if err := addMissingColumn(db, "downloaded_files", "post_action", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	if err := addMissingColumn(db, "downloaded_files", "post_action_path", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	return addMissingColumn(db, "downloaded_files", "marker", `TEXT NOT NULL DEFAULT ''`)
+}
+
+// addMissingColumn upgrades databases created by older versions by adding
+// column to table when it does not exist yet.
+func addMissingColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading table info: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("error scanning table info: %v", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over table info: %v", err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding column %s: %v", column, err)
+	}
 	return nil
 }
 
 func saveDownloadedFileEntry(db *sql.DB, file DownloadedFile) error {
-	insertFileSQL := `INSERT INTO downloaded_files (file_name, file_size, download_time, server_name) VALUES (?, ?, ?, ?)`
-	_, err := db.Exec(insertFileSQL, file.FileName, file.FileSize, file.DownloadTime, file.ServerName)
+	if file.Direction == "" {
+		file.Direction = directionDownload
+	}
+	insertFileSQL := `INSERT INTO downloaded_files (file_name, file_size, download_time, server_name, direction, checksum, post_action, post_action_path, marker) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(insertFileSQL, file.FileName, file.FileSize, file.DownloadTime, file.ServerName, file.Direction, file.Checksum, file.PostAction, file.PostActionPath, file.Marker)
 	if err != nil {
 		return fmt.Errorf("error inserting file entry: %v", err)
 	}
-	logger.Printf("File entry saved: %s, size: %s, downloaded at: %s\n", file.FileName, bytesToHumanReadable(file.FileSize), file.DownloadTime)
+	logger.Printf("File entry saved: %s, size: %s, %sed at: %s\n", file.FileName, bytesToHumanReadable(file.FileSize), file.Direction, file.DownloadTime)
 	return nil
 }
+
 func searchDownloadedFileEntries(db *sql.DB, fileName string, fileSize int64, serverName string) ([]DownloadedFile, error) {
-	query := `SELECT file_name, file_size, download_time, server_name FROM downloaded_files WHERE file_name = ? AND file_size = ? AND server_name = ?`
-	rows, err := db.Query(query, fileName, fileSize, serverName)
+	return searchTransferEntries(db, fileName, fileSize, serverName, directionDownload)
+}
+
+func searchTransferEntries(db *sql.DB, fileName string, fileSize int64, serverName, direction string) ([]DownloadedFile, error) {
+	query := `SELECT file_name, file_size, download_time, server_name, direction, checksum, post_action, post_action_path, marker FROM downloaded_files WHERE file_name = ? AND file_size = ? AND server_name = ? AND direction = ?`
+	rows, err := db.Query(query, fileName, fileSize, serverName, direction)
 	if err != nil {
 		return nil, fmt.Errorf("error querying file entries: %v", err)
 	}
@@ -57,7 +206,7 @@ func searchDownloadedFileEntries(db *sql.DB, fileName string, fileSize int64, se
 	var files []DownloadedFile
 	for rows.Next() {
 		var file DownloadedFile
-		err := rows.Scan(&file.FileName, &file.FileSize, &file.DownloadTime, &file.ServerName)
+		err := rows.Scan(&file.FileName, &file.FileSize, &file.DownloadTime, &file.ServerName, &file.Direction, &file.Checksum, &file.PostAction, &file.PostActionPath, &file.Marker)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning row: %v", err)
 		}
@@ -71,18 +220,165 @@ func searchDownloadedFileEntries(db *sql.DB, fileName string, fileSize int64, se
 	return files, nil
 }
 
+// saveMarkerDone records that the marker of a downloaded file was handled.
+func saveMarkerDone(db *sql.DB, fileName string, fileSize int64, serverName, action string) error {
+	_, err := db.Exec(`UPDATE downloaded_files SET marker = ? WHERE file_name = ? AND file_size = ? AND server_name = ? AND direction = ? AND marker = ?`,
+		action, fileName, fileSize, serverName, directionDownload, markerPending)
+	if err != nil {
+		return fmt.Errorf("error updating marker state: %v", err)
+	}
+	return nil
+}
+
+func saveRouteDelivery(db *sql.DB, delivery RouteDelivery) error {
+	insertSQL := `INSERT INTO route_deliveries (route_name, destination, file_name, file_size, delivery_time) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.Exec(insertSQL, delivery.RouteName, delivery.Destination, delivery.FileName, delivery.FileSize, delivery.DeliveryTime)
+	if err != nil {
+		return fmt.Errorf("error inserting route delivery: %v", err)
+	}
+	return nil
+}
+
+func searchRouteDeliveries(db *sql.DB, routeName, fileName string, fileSize int64) ([]RouteDelivery, error) {
+	query := `SELECT route_name, destination, file_name, file_size, delivery_time FROM route_deliveries WHERE route_name = ? AND file_name = ? AND file_size = ?`
+	rows, err := db.Query(query, routeName, fileName, fileSize)
+	if err != nil {
+		return nil, fmt.Errorf("error querying route deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []RouteDelivery
+	for rows.Next() {
+		var delivery RouteDelivery
+		err := rows.Scan(&delivery.RouteName, &delivery.Destination, &delivery.FileName, &delivery.FileSize, &delivery.DeliveryTime)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+// observePendingFile records one listing of a file. The observation count
+// restarts whenever the size or modification time differs from the last one.
+func observePendingFile(db *sql.DB, serverName, filePath string, fileSize int64, modTime string, now time.Time) (PendingFile, error) {
+	pending := PendingFile{ServerName: serverName, FilePath: filePath}
+	query := `SELECT file_size, mod_time, first_seen, listings FROM pending_files WHERE server_name = ? AND file_path = ?`
+	err := db.QueryRow(query, serverName, filePath).Scan(&pending.FileSize, &pending.ModTime, &pending.FirstSeen, &pending.Listings)
+	if err != nil && err != sql.ErrNoRows {
+		return PendingFile{}, fmt.Errorf("error querying pending file: %v", err)
+	}
+
+	seen := now.Format(pendingTimeFormat)
+	if err == sql.ErrNoRows || pending.FileSize != fileSize || pending.ModTime != modTime {
+		pending.FileSize, pending.ModTime, pending.FirstSeen, pending.Listings = fileSize, modTime, seen, 0
+	}
+	pending.Listings++
+
+	upsertSQL := `INSERT OR REPLACE INTO pending_files (server_name, file_path, file_size, mod_time, first_seen, last_seen, listings) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(upsertSQL, serverName, filePath, pending.FileSize, pending.ModTime, pending.FirstSeen, seen, pending.Listings)
+	if err != nil {
+		return PendingFile{}, fmt.Errorf("error saving pending file: %v", err)
+	}
+	return pending, nil
+}
+
+func deletePendingFile(db *sql.DB, serverName, filePath string) error {
+	_, err := db.Exec(`DELETE FROM pending_files WHERE server_name = ? AND file_path = ?`, serverName, filePath)
+	if err != nil {
+		return fmt.Errorf("error deleting pending file: %v", err)
+	}
+	return nil
+}
+
+// saveLastRun records the start of the last pass over a connection that
+// completed without failures.
+func saveLastRun(db *sql.DB, serverName string, start time.Time) error {
+	upsertSQL := `INSERT OR REPLACE INTO connection_runs (server_name, last_run) VALUES (?, ?)`
+	_, err := db.Exec(upsertSQL, serverName, start.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return fmt.Errorf("error saving last run: %v", err)
+	}
+	return nil
+}
+
+// loadLastRun returns the time saved by saveLastRun, zero if there is none.
+func loadLastRun(db *sql.DB, serverName string) (time.Time, error) {
+	var lastRun string
+	err := db.QueryRow(`SELECT last_run FROM connection_runs WHERE server_name = ?`, serverName).Scan(&lastRun)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error querying last run: %v", err)
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", lastRun, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing last run: %v", err)
+	}
+	return t, nil
+}
+
+func saveConnectionError(db *sql.DB, serverName, message string) error {
+	upsertSQL := `INSERT OR REPLACE INTO connection_errors (server_name, error, error_time) VALUES (?, ?, datetime('now', 'localtime'))`
+	_, err := db.Exec(upsertSQL, serverName, message)
+	if err != nil {
+		return fmt.Errorf("error saving connection error: %v", err)
+	}
+	return nil
+}
+
+func clearConnectionError(db *sql.DB, serverName string) error {
+	_, err := db.Exec(`DELETE FROM connection_errors WHERE server_name = ?`, serverName)
+	if err != nil {
+		return fmt.Errorf("error clearing connection error: %v", err)
+	}
+	return nil
+}
+
+func listConnectionErrors(db *sql.DB) ([]ConnectionError, error) {
+	rows, err := db.Query(`SELECT server_name, error, error_time FROM connection_errors ORDER BY error_time DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying connection errors: %v", err)
+	}
+	defer rows.Close()
+
+	var connErrors []ConnectionError
+	for rows.Next() {
+		var connErr ConnectionError
+		if err := rows.Scan(&connErr.ServerName, &connErr.Error, &connErr.ErrorTime); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+		connErrors = append(connErrors, connErr)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return connErrors, nil
+}
+
 func truncateDatabase(db *sql.DB) error {
-	truncateSQL := `DELETE FROM downloaded_files`
+	truncateSQL := `DELETE FROM downloaded_files; DELETE FROM route_deliveries; DELETE FROM pending_files;
+		DELETE FROM connection_runs; DELETE FROM connection_errors`
 	_, err := db.Exec(truncateSQL)
 	if err != nil {
 		return fmt.Errorf("error truncating table: %v", err)
 	}
-	logger.Println("All entries in the downloaded_files table have been deleted.")
+	logger.Println("All entries in the downloaded_files, route_deliveries, pending_files, connection_runs and connection_errors tables have been deleted.")
 	return nil
 }
 
 func deleteOldEntries(db *sql.DB) error {
-	deleteSQL := `DELETE FROM downloaded_files WHERE download_time < datetime('now', '-7 days')`
+	deleteSQL := `DELETE FROM downloaded_files WHERE download_time < datetime('now', '-7 days');
+		DELETE FROM route_deliveries WHERE delivery_time < datetime('now', '-7 days');
+		DELETE FROM pending_files WHERE last_seen < datetime('now', 'localtime', '-7 days')`
 	_, err := db.Exec(deleteSQL)
 	if err != nil {
 		return fmt.Errorf("error deleting old entries: %v", err)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateTableUpgradesOldSchema(t *testing.T) {
+	conn, err := openDatabaseAt(filepath.Join(t.TempDir(), "downloads.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+
+	// Schema and data as written by versions without the direction column
+	_, err = conn.Exec(`CREATE TABLE downloaded_files (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"file_name" TEXT,
+		"server_name" TEXT,
+		"file_size" INTEGER,
+		"download_time" TEXT
+	);
+	INSERT INTO downloaded_files (file_name, server_name, file_size, download_time) VALUES ('old.txt', 'sftp_conn_1', 3, '2024-07-20 15:11:25');`)
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	if err := createTable(conn); err != nil {
+		t.Fatalf("createTable failed: %v", err)
+	}
+	// Running the upgrade twice must be a no-op
+	if err := createTable(conn); err != nil {
+		t.Fatalf("createTable failed on second run: %v", err)
+	}
+
+	files, err := searchDownloadedFileEntries(conn, "old.txt", 3, "sftp_conn_1")
+	if err != nil || len(files) != 1 || files[0].Direction != directionDownload {
+		t.Errorf("Expected old entry to be treated as a download, got %v (err: %v)", files, err)
+	}
+}
+
+func TestTruncateDatabaseClearsAllTables(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	if err := saveDownloadedFileEntry(db.conn, DownloadedFile{FileName: "a.csv", ServerName: "c", FileSize: 1}); err != nil {
+		t.Fatalf("saveDownloadedFileEntry failed: %v", err)
+	}
+	if err := saveRouteDelivery(db.conn, RouteDelivery{RouteName: "r", Destination: "d", FileName: "a.csv", FileSize: 1}); err != nil {
+		t.Fatalf("saveRouteDelivery failed: %v", err)
+	}
+	if _, err := observePendingFile(db.conn, "c", "/in/a.csv", 1, "", now); err != nil {
+		t.Fatalf("observePendingFile failed: %v", err)
+	}
+	if err := saveLastRun(db.conn, "c", now); err != nil {
+		t.Fatalf("saveLastRun failed: %v", err)
+	}
+	if err := saveConnectionError(db.conn, "c", "host key mismatch"); err != nil {
+		t.Fatalf("saveConnectionError failed: %v", err)
+	}
+
+	if err := truncateDatabase(db.conn); err != nil {
+		t.Fatalf("truncateDatabase failed: %v", err)
+	}
+	for _, table := range []string{"downloaded_files", "route_deliveries", "pending_files", "connection_runs", "connection_errors"} {
+		var count int
+		if err := db.conn.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil || count != 0 {
+			t.Errorf("Expected %s to be empty, got %d rows (err: %v)", table, count, err)
+		}
+	}
+}
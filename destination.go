@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholderPattern finds the {placeholders} of a destination template.
+var placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// destinationPlaceholders are the placeholders available besides the
+// capture groups of Regex, which are referenced by number or name.
+var destinationPlaceholders = map[string]bool{
+	"connection": true,
+	"yyyy":       true,
+	"mm":         true,
+	"dd":         true,
+	"remote_dir": true,
+	"name":       true,
+	"base":       true,
+	"ext":        true,
+}
+
+// destination lays out downloaded files according to the destination
+// template of a connection, e.g. "{connection}/{yyyy}/{mm}/{dd}/{name}".
+type destination struct {
+	conn     Connection
+	template string
+	regex    *regexp.Regexp
+}
+
+func validateDestination(conn Connection) error {
+	if conn.Destination == "" {
+		return nil
+	}
+	if conn.Direction == directionUpload {
+		return fmt.Errorf("destination is not supported for uploads: %s", conn.Name)
+	}
+	if path.IsAbs(conn.Destination) || strings.HasSuffix(conn.Destination, "/") {
+		return fmt.Errorf("destination for %s must be a file path relative to the download folder: %s", conn.Name, conn.Destination)
+	}
+	rest := placeholderPattern.ReplaceAllString(conn.Destination, "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unbalanced braces in destination for %s: %s", conn.Name, conn.Destination)
+	}
+
+	// Checked by validateFilters
+	regex, _ := regexp.Compile(conn.Regex)
+	for _, match := range placeholderPattern.FindAllStringSubmatch(conn.Destination, -1) {
+		name := match[1]
+		if destinationPlaceholders[name] {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil && n >= 0 && n <= regex.NumSubexp() {
+			continue
+		}
+		if name != "" && regex.SubexpIndex(name) >= 0 {
+			continue
+		}
+		return fmt.Errorf("unknown placeholder {%s} in destination for %s", name, conn.Name)
+	}
+	return nil
+}
+
+// newDestination prepares the template of conn, nil when files mirror the
+// remote tree.
+func newDestination(conn Connection) *destination {
+	if conn.Destination == "" {
+		return nil
+	}
+	d := &destination{conn: conn, template: conn.Destination}
+	if conn.Regex != "" {
+		d.regex, _ = regexp.Compile(conn.Regex)
+	}
+	return d
+}
+
+// localPath returns where a file found at relPath below the connection path
+// is stored inside localDir. Without a template the remote tree is mirrored.
+func (d *destination) localPath(localDir string, file RemoteEntry, relPath string, now time.Time) (string, error) {
+	if d == nil {
+		return path.Join(localDir, relPath), nil
+	}
+
+	ext := path.Ext(file.Name)
+	values := map[string]string{
+		"connection": d.conn.Name,
+		"yyyy":       now.Format("2006"),
+		"mm":         now.Format("01"),
+		"dd":         now.Format("02"),
+		"remote_dir": path.Dir(relPath),
+		"name":       file.Name,
+		"base":       strings.TrimSuffix(file.Name, ext),
+		"ext":        strings.TrimPrefix(ext, "."),
+	}
+	if values["remote_dir"] == "." {
+		values["remote_dir"] = ""
+	}
+	if d.regex != nil {
+		if match := d.regex.FindStringSubmatch(file.Name); match != nil {
+			for i, value := range match {
+				values[strconv.Itoa(i)] = value
+				if name := d.regex.SubexpNames()[i]; name != "" {
+					values[name] = value
+				}
+			}
+		}
+	}
+
+	rel := placeholderPattern.ReplaceAllStringFunc(d.template, func(placeholder string) string {
+		return values[placeholder[1:len(placeholder)-1]]
+	})
+	rel = path.Clean(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("destination %q for %s is not a file inside the download folder", rel, relPath)
+	}
+	return path.Join(localDir, rel), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDestinationLocalPath(t *testing.T) {
+	now := time.Date(2024, 3, 7, 12, 0, 0, 0, time.Local)
+	file := RemoteEntry{Name: "ORD_4711_20240306.csv", Kind: EntryFile}
+	for template, want := range map[string]string{
+		"":                                     "/dl/in/2024/ORD_4711_20240306.csv",
+		"{connection}/{yyyy}/{mm}/{dd}/{name}": "/dl/partner/2024/03/07/ORD_4711_20240306.csv",
+		"{remote_dir}/{base}.{ext}":            "/dl/in/2024/ORD_4711_20240306.csv",
+		"orders/{customer}/{2}.{ext}":          "/dl/orders/4711/20240306.csv",
+	} {
+		conn := Connection{Name: "partner", Regex: `^ORD_(?P<customer>\d+)_(\d+)\.csv$`, Destination: template}
+		if err := validateDestination(conn); err != nil {
+			t.Errorf("validateDestination(%q) failed: %v", template, err)
+			continue
+		}
+		got, err := newDestination(conn).localPath("/dl", file, "in/2024/"+file.Name, now)
+		if err != nil || got != want {
+			t.Errorf("localPath(%q) = %q, %v; want %q", template, got, err, want)
+		}
+	}
+
+	// Top level files have an empty remote_dir
+	d := newDestination(Connection{Name: "partner", Destination: "{remote_dir}/{name}"})
+	if got, err := d.localPath("/dl", file, file.Name, now); err != nil || got != "/dl/"+file.Name {
+		t.Errorf("Unexpected path for a top level file: %q (err: %v)", got, err)
+	}
+	d = newDestination(Connection{Name: "partner", Destination: "../{name}"})
+	if _, err := d.localPath("/dl", file, file.Name, now); err == nil {
+		t.Errorf("Expected a destination outside the download folder to be rejected")
+	}
+}
+
+func TestValidateDestination(t *testing.T) {
+	for _, conn := range []Connection{
+		{Name: "d", Destination: "/abs/{name}"},
+		{Name: "d", Destination: "{yyyy}/"},
+		{Name: "d", Destination: "{unknown}/{name}"},
+		{Name: "d", Destination: "{yyyy/{name}"},
+		{Name: "d", Regex: `(\d+)`, Destination: "{2}/{name}"},
+		{Name: "d", Destination: "{name}", Direction: directionUpload},
+	} {
+		if err := validateDestination(conn); err == nil {
+			t.Errorf("Expected %q to be rejected", conn.Destination)
+		}
+	}
+}
+
+func TestDownloadToDestination(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{"/in/sub/a.csv": []byte("alpha")}}
+	conn := Connection{Name: "templated", Path: "/in", Depth: 2, Destination: "{connection}/{yyyy}{mm}{dd}/{base}.{ext}"}
+
+	handleDownload(conn, fm)
+	want := filepath.Join(download_folder, "templated", time.Now().Format("20060102"), "a.csv")
+	if data, err := os.ReadFile(want); err != nil || string(data) != "alpha" {
+		t.Errorf("Expected the file at %s: %q (err: %v)", want, data, err)
+	}
+}
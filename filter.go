@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fileFilter selects the files a connection transfers. It is built once per
+// pass and shared by the traversal of every protocol, so all of them apply
+// the same rules.
+type fileFilter struct {
+	conn      Connection
+	regex     *regexp.Regexp
+	pathRegex *regexp.Regexp
+
+	// now is the start of the pass, lastRun the start of the last pass that
+	// completed without failures, zero when unknown
+	now     time.Time
+	lastRun time.Time
+}
+
+func validateFilters(conn Connection) error {
+	if _, err := regexp.Compile(conn.Regex); err != nil {
+		return fmt.Errorf("invalid regex for %s: %v", conn.Name, err)
+	}
+	if _, err := regexp.Compile(conn.PathRegex); err != nil {
+		return fmt.Errorf("invalid path_regex for %s: %v", conn.Name, err)
+	}
+	for _, pattern := range append(append([]string(nil), conn.Include...), conn.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob for %s: %q", conn.Name, pattern)
+		}
+	}
+	if conn.MinSize < 0 || conn.MaxSize < 0 || conn.MaxSize > 0 && conn.MinSize > conn.MaxSize {
+		return fmt.Errorf("invalid size range for %s: %d-%d", conn.Name, conn.MinSize, conn.MaxSize)
+	}
+	if conn.MinAge < 0 || conn.MaxAge < 0 || conn.MaxAge > 0 && conn.MinAge > conn.MaxAge {
+		return fmt.Errorf("invalid age range for %s: %d-%d", conn.Name, conn.MinAge, conn.MaxAge)
+	}
+	if conn.LastRunMargin < 0 {
+		return fmt.Errorf("invalid last_run_margin for %s: %d", conn.Name, conn.LastRunMargin)
+	}
+	if conn.NewerThanLastRun && conn.Direction == directionUpload {
+		return fmt.Errorf("newer_than_last_run is not supported for uploads: %s", conn.Name)
+	}
+	return nil
+}
+
+// newFileFilter prepares the filter of conn for a pass starting at now.
+// Settings were checked by readConfig.
+func newFileFilter(conn Connection, now time.Time) *fileFilter {
+	f := &fileFilter{conn: conn, now: now}
+	if conn.Regex != "" {
+		f.regex, _ = regexp.Compile(conn.Regex)
+	}
+	if conn.PathRegex != "" {
+		f.pathRegex, _ = regexp.Compile(conn.PathRegex)
+	}
+	if conn.NewerThanLastRun {
+		db.mu.Lock()
+		lastRun, err := loadLastRun(db.conn, conn.Name)
+		db.mu.Unlock()
+		if err != nil {
+			logger.Debugf("Error loading last run: %v\n", err)
+		}
+		f.lastRun = lastRun
+	}
+	return f
+}
+
+// matchFolder reports whether the traversal descends into the folder at
+// folderPath. The archive of the archive post action and the local archive
+// of uploads are never walked.
+func (f *fileFilter) matchFolder(name, folderPath string) bool {
+	if f == nil {
+		return true
+	}
+	if f.conn.PostAction == postArchive && path.Clean(folderPath) == archiveDir(f.conn) {
+		return false
+	}
+	if f.conn.Direction == directionUpload && f.conn.LocalArchive != "" && sameLocalPath(folderPath, f.conn.LocalArchive) {
+		return false
+	}
+	return !(f.conn.SkipHidden && strings.HasPrefix(name, "."))
+}
+
+// sameLocalPath reports whether a and b name the same local folder, relative
+// paths being resolved against the working directory.
+func sameLocalPath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// matchFile reports whether file, found at relPath below the connection
+// path, is selected. Age filters ignore files without a modification time.
+func (f *fileFilter) matchFile(file RemoteEntry, relPath string) bool {
+	if f == nil {
+		return true
+	}
+	conn := f.conn
+	if conn.SkipHidden && strings.HasPrefix(file.Name, ".") {
+		return false
+	}
+	if isPostActionResult(conn, file.Name) {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(file.Name) {
+		return false
+	}
+	if f.pathRegex != nil && !f.pathRegex.MatchString(relPath) {
+		return false
+	}
+	if len(conn.Include) > 0 && !matchGlobs(conn.Include, file.Name, relPath) {
+		return false
+	}
+	if matchGlobs(conn.Exclude, file.Name, relPath) {
+		return false
+	}
+	if file.Size < conn.MinSize || conn.MaxSize > 0 && file.Size > conn.MaxSize {
+		logger.Debugf("File size outside of range, skipping: %s\n", relPath)
+		return false
+	}
+	if file.ModTime.IsZero() {
+		return true
+	}
+	age := f.now.Sub(file.ModTime)
+	if conn.MinAge > 0 && age < time.Duration(conn.MinAge)*time.Second || conn.MaxAge > 0 && age > time.Duration(conn.MaxAge)*time.Second {
+		logger.Debugf("File age outside of range, skipping: %s\n", relPath)
+		return false
+	}
+	if !f.lastRun.IsZero() && !file.ModTime.After(f.lastRun.Add(-lastRunMargin(conn))) {
+		return false
+	}
+	return true
+}
+
+// lastRunMargin is how much older than the last run a file may be and still
+// be picked up by newer_than_last_run, for server clocks running behind and
+// files whose modification time is set before their upload finished.
+func lastRunMargin(conn Connection) time.Duration {
+	if conn.LastRunMargin == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(conn.LastRunMargin) * time.Second
+}
+
+// matchGlobs reports whether any pattern matches. Patterns containing a
+// slash are matched against the relative path, others against the name.
+func matchGlobs(patterns []string, name, relPath string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if strings.Contains(pattern, "/") {
+			subject = relPath
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// finishRun records the start of a pass that left no file behind, the
+// reference for newer_than_last_run on the next pass.
+func (f *fileFilter) finishRun() {
+	if f == nil || !f.conn.NewerThanLastRun {
+		return
+	}
+	db.mu.Lock()
+	err := saveLastRun(db.conn, f.conn.Name, f.now)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error saving last run: %v\n", err)
+	}
+}
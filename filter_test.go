@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileFilterMatchFile(t *testing.T) {
+	now := time.Now()
+	conn := Connection{
+		Name:       "filters",
+		Include:    []string{"*.csv", "reports/*.xml"},
+		Exclude:    []string{"tmp_*"},
+		PathRegex:  `^(reports|2024)/`,
+		MinSize:    10,
+		MaxSize:    1000,
+		MinAge:     60,
+		MaxAge:     86400,
+		SkipHidden: true,
+	}
+	if err := validateFilters(conn); err != nil {
+		t.Fatalf("validateFilters failed: %v", err)
+	}
+	filter := newFileFilter(conn, now)
+
+	old := now.Add(-time.Hour)
+	for _, tc := range []struct {
+		name    string
+		relPath string
+		size    int64
+		modTime time.Time
+		want    bool
+	}{
+		{"a.csv", "2024/a.csv", 100, old, true},
+		{"a.xml", "reports/a.xml", 100, old, true},
+		{"a.xml", "2024/a.xml", 100, old, false},
+		{"a.csv", "other/a.csv", 100, old, false},
+		{"tmp_a.csv", "2024/tmp_a.csv", 100, old, false},
+		{".a.csv", "2024/.a.csv", 100, old, false},
+		{"a.csv", "2024/a.csv", 5, old, false},
+		{"a.csv", "2024/a.csv", 5000, old, false},
+		{"a.csv", "2024/a.csv", 100, now.Add(-time.Second), false},
+		{"a.csv", "2024/a.csv", 100, now.Add(-48 * time.Hour), false},
+		{"a.csv", "2024/a.csv", 100, time.Time{}, true},
+	} {
+		file := RemoteEntry{Name: tc.name, Kind: EntryFile, Size: tc.size, ModTime: tc.modTime}
+		if got := filter.matchFile(file, tc.relPath); got != tc.want {
+			t.Errorf("matchFile(%s, size %d, mtime %v) = %t, want %t", tc.relPath, tc.size, tc.modTime, got, tc.want)
+		}
+	}
+	if filter.matchFolder(".git", "/in/.git") || !filter.matchFolder("reports", "/in/reports") {
+		t.Errorf("Expected only hidden folders to be skipped")
+	}
+	var none *fileFilter
+	if !none.matchFile(RemoteEntry{Name: ".x"}, ".x") || !none.matchFolder(".x", "/.x") {
+		t.Errorf("Expected a nil filter to select everything")
+	}
+}
+
+func TestDownloadNewerThanLastRun(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fixedTimeManager{fakeManager{files: map[string][]byte{"/in/a.csv": []byte("alpha")}}}
+	conn := Connection{Name: "incremental", Path: "/in", Depth: 1, NewerThanLastRun: true}
+
+	handleDownload(conn, fm)
+	if _, err := os.Stat(filepath.Join(download_folder, "a.csv")); err != nil {
+		t.Fatalf("Expected the first run to download everything: %v", err)
+	}
+	lastRun, err := loadLastRun(db.conn, conn.Name)
+	if err != nil || lastRun.IsZero() {
+		t.Fatalf("Expected the run to be recorded, got %v (err: %v)", lastRun, err)
+	}
+
+	// A new file whose modification time is older than the recorded run is
+	// not picked up
+	fm.files["/in/b.csv"] = []byte("bravo")
+	handleDownload(conn, fm)
+	if _, err := os.Stat(filepath.Join(download_folder, "b.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected a file older than the last run to be skipped")
+	}
+}
+
+func TestNewerThanLastRunMargin(t *testing.T) {
+	lastRun := time.Now().Add(-time.Hour)
+	for _, tc := range []struct {
+		margin int
+		age    time.Duration
+		want   bool
+	}{
+		{0, 30 * time.Second, true},
+		{0, 90 * time.Second, false},
+		{600, 5 * time.Minute, true},
+		{600, 15 * time.Minute, false},
+	} {
+		conn := Connection{Name: "margin", NewerThanLastRun: true, LastRunMargin: tc.margin}
+		filter := &fileFilter{conn: conn, now: time.Now(), lastRun: lastRun}
+		file := RemoteEntry{Name: "a.csv", Kind: EntryFile, ModTime: lastRun.Add(-tc.age)}
+		if got := filter.matchFile(file, "a.csv"); got != tc.want {
+			t.Errorf("Margin %d, file %v older than the last run: got %t, want %t", tc.margin, tc.age, got, tc.want)
+		}
+	}
+}
+
+// brokenFolderManager fails to list one folder, like a folder the account
+// has no permission for.
+type brokenFolderManager struct {
+	fakeManager
+	broken string
+}
+
+func (fm *brokenFolderManager) readDir(remotePath string) ([]RemoteEntry, error) {
+	if remotePath == fm.broken {
+		return nil, os.ErrPermission
+	}
+	return fm.fakeManager.readDir(remotePath)
+}
+
+func TestFolderFailureKeepsLastRun(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &brokenFolderManager{fakeManager{files: map[string][]byte{
+		"/in/a.csv":        []byte("alpha"),
+		"/in/locked/b.csv": []byte("bravo"),
+	}}, "/in/locked"}
+	conn := Connection{Name: "incremental", Path: "/in", Depth: 2, NewerThanLastRun: true}
+
+	if err := recursivelyDownload(conn.Path, download_folder, conn.Depth, fm, conn); err == nil {
+		t.Errorf("Expected the listing failure of a folder to be reported")
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "a.csv")); err != nil {
+		t.Errorf("Expected the other folders to be downloaded: %v", err)
+	}
+	lastRun, err := loadLastRun(db.conn, conn.Name)
+	if err != nil || !lastRun.IsZero() {
+		t.Errorf("Expected no run to be recorded, got %v (err: %v)", lastRun, err)
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	for _, conn := range []Connection{
+		{Name: "f", Regex: "("},
+		{Name: "f", PathRegex: "["},
+		{Name: "f", Include: []string{"[a-"}},
+		{Name: "f", MinSize: 10, MaxSize: 5},
+		{Name: "f", MinAge: -1},
+		{Name: "f", LastRunMargin: -1},
+		{Name: "f", NewerThanLastRun: true, Direction: directionUpload},
+	} {
+		if err := validateFilters(conn); err == nil {
+			t.Errorf("Expected %+v to be rejected", conn)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFTPResumeDownload(t *testing.T) {
+	content := "0123456789abcdefghij"
+
+	// The partial file is marked so the test can tell a resume from a restart
+	partial := "XXXXXXXX"
+
+	for _, tc := range []struct {
+		name    string
+		restOff bool
+		want    string
+	}{
+		{"rest", false, partial + content[len(partial):]},
+		{"rest refused", true, content},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(root, "big.bin"), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			srv := startTestFTPServer(t, root, nil, false)
+			if tc.restOff {
+				srv.disable("REST")
+			}
+
+			conn := Connection{Name: "resume", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass"}
+			file := RemoteEntry{Name: "big.bin", Size: int64(len(content)), Kind: EntryFile}
+
+			// A partial download left behind by a dropped link
+			local := filepath.Join(t.TempDir(), "big.bin")
+			if err := os.WriteFile(local+partSuffix, []byte(partial), 0644); err != nil {
+				t.Fatalf("Failed to write partial file: %v", err)
+			}
+			if err := writePartMeta(local+partMetaSuffix, newPartMeta(conn, file, "/big.bin")); err != nil {
+				t.Fatalf("Failed to write partial file metadata: %v", err)
+			}
+
+			fm := &ManagerFTP{}
+			if err := fm.connect(conn); err != nil {
+				t.Fatalf("connect failed: %v", err)
+			}
+			defer fm.close()
+
+			if _, err := resumableDownload(fm, conn, file, "/big.bin", local); err != nil {
+				t.Fatalf("resumableDownload failed: %v", err)
+			}
+			data, err := os.ReadFile(local)
+			if err != nil || string(data) != tc.want {
+				t.Errorf("Expected %q after download, got %q (err: %v)", tc.want, data, err)
+			}
+			if !srv.received("REST") {
+				t.Errorf("Expected REST to be sent")
+			}
+		})
+	}
+}
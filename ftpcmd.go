@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpCommandConn is a bare FTP control connection for commands jlaffaye/ftp
+// has no API for, such as the HASH and XMD5 extensions. It is opened next to
+// the connection of the library, the same way and with the same login.
+type ftpCommandConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// dialFTPCommand opens and logs in a command connection. dial returns the
+// control connection, already wrapped in TLS for implicit FTPS.
+func dialFTPCommand(dial func(network, addr string) (net.Conn, error), addr string, tlsConfig *tls.Config, explicitTLS bool, username, password string) (*ftpCommandConn, error) {
+	netConn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpCommandConn{conn: netConn, text: textproto.NewConn(netConn)}
+	if _, _, err := c.text.ReadResponse(ftp.StatusReady); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if explicitTLS {
+		if _, _, err := c.cmd(ftp.StatusAuthOK, "AUTH TLS"); err != nil {
+			c.close()
+			return nil, err
+		}
+		c.conn = tls.Client(netConn, tlsConfig)
+		c.text = textproto.NewConn(c.conn)
+	}
+
+	code, _, err := c.cmd(0, "USER %s", username)
+	if err == nil && code == ftp.StatusUserOK {
+		code, _, err = c.cmd(0, "PASS %s", password)
+	}
+	if err == nil && code != ftp.StatusLoggedIn {
+		err = fmt.Errorf("login failed with code %d", code)
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads its reply. expect follows the rules of
+// textproto.Reader.ReadResponse, 0 accepts any code.
+func (c *ftpCommandConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+func (c *ftpCommandConn) close() error {
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	c.cmd(0, "QUIT")
+	return c.conn.Close()
+}
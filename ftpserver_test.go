@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testFTPServer is a minimal FTP/FTPS server serving a local directory. It
+// implements just enough of RFC 959 and RFC 3659 for the jlaffaye/ftp client.
+type testFTPServer struct {
+	root      string
+	tlsConfig *tls.Config
+	implicit  bool
+	listener  net.Listener
+
+	mu        sync.Mutex
+	commands  []string
+	arguments map[string][]string
+	disabled  map[string]bool
+}
+
+func startTestFTPServer(t *testing.T, root string, tlsConfig *tls.Config, implicit bool) *testFTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &testFTPServer{root: root, tlsConfig: tlsConfig, implicit: implicit, listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(c)
+		}
+	}()
+	return srv
+}
+
+func (srv *testFTPServer) port() int {
+	return srv.listener.Addr().(*net.TCPAddr).Port
+}
+
+// received reports whether a command with the given verb was sent by a client.
+func (srv *testFTPServer) received(verb string) bool {
+	return srv.count(verb) > 0
+}
+
+// count returns how many times clients sent a command with the given verb.
+func (srv *testFTPServer) count(verb string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	n := 0
+	for _, c := range srv.commands {
+		if c == verb {
+			n++
+		}
+	}
+	return n
+}
+
+// args returns the arguments clients sent with verb, in order.
+func (srv *testFTPServer) args(verb string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.arguments[verb]...)
+}
+
+// disable makes the server answer verb with 502 as if it was not implemented.
+func (srv *testFTPServer) disable(verb string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.disabled == nil {
+		srv.disabled = make(map[string]bool)
+	}
+	srv.disabled[verb] = true
+}
+
+func (srv *testFTPServer) local(name string) string {
+	return filepath.Join(srv.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+type testFTPSession struct {
+	srv      *testFTPServer
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	passive  net.Listener
+	protData bool
+	offset   int64
+	renameFr string
+	hashAlg  string
+}
+
+func (srv *testFTPServer) serve(c net.Conn) {
+	if srv.implicit {
+		c = tls.Server(c, srv.tlsConfig)
+	}
+	s := &testFTPSession{srv: srv, conn: c, rw: bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))}
+	defer c.Close()
+
+	s.reply("220 test server ready")
+	for {
+		line, err := s.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		srv.mu.Lock()
+		srv.commands = append(srv.commands, verb)
+		if srv.arguments == nil {
+			srv.arguments = make(map[string][]string)
+		}
+		srv.arguments[verb] = append(srv.arguments[verb], arg)
+		disabled := srv.disabled[verb]
+		srv.mu.Unlock()
+		if disabled {
+			s.reply("502 %s not implemented", verb)
+			continue
+		}
+		if !s.handle(verb, arg) {
+			return
+		}
+	}
+}
+
+func (s *testFTPSession) reply(format string, args ...interface{}) {
+	fmt.Fprintf(s.rw, format+"\r\n", args...)
+	s.rw.Flush()
+}
+
+func (s *testFTPSession) handle(verb, arg string) bool {
+	switch verb {
+	case "USER":
+		s.reply("331 password required")
+	case "PASS":
+		s.reply("230 logged in")
+	case "AUTH":
+		if s.srv.tlsConfig == nil {
+			s.reply("502 TLS not configured")
+			return true
+		}
+		s.reply("234 starting TLS")
+		s.conn = tls.Server(s.conn, s.srv.tlsConfig)
+		s.rw = bufio.NewReadWriter(bufio.NewReader(s.conn), bufio.NewWriter(s.conn))
+	case "PBSZ":
+		s.reply("200 PBSZ=0")
+	case "PROT":
+		s.protData = arg == "P"
+		s.reply("200 protection level set")
+	case "FEAT":
+		s.reply("211-Features:\r\n MLST type*;size*;modify*;\r\n REST STREAM\r\n SIZE\r\n211 End")
+	case "OPTS":
+		if name, ok := strings.CutPrefix(strings.ToUpper(arg), "HASH "); ok {
+			s.hashAlg = name
+		}
+		s.reply("200 ok")
+	case "TYPE", "NOOP":
+		s.reply("200 ok")
+	case "PWD":
+		s.reply(`257 "/" is the current directory`)
+	case "CWD":
+		if info, err := os.Stat(s.srv.local(arg)); err != nil || !info.IsDir() {
+			s.reply("550 no such directory")
+			return true
+		}
+		s.reply("250 ok")
+	case "EPSV":
+		if err := s.listenPassive(); err != nil {
+			s.reply("425 %v", err)
+			return true
+		}
+		s.reply("229 Entering Extended Passive Mode (|||%d|)", s.passive.Addr().(*net.TCPAddr).Port)
+	case "PASV":
+		if err := s.listenPassive(); err != nil {
+			s.reply("425 %v", err)
+			return true
+		}
+		port := s.passive.Addr().(*net.TCPAddr).Port
+		s.reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+	case "MLSD", "LIST":
+		s.list(arg)
+	case "SIZE":
+		info, err := os.Stat(s.srv.local(arg))
+		if err != nil {
+			s.reply("550 %v", err)
+			return true
+		}
+		s.reply("213 %d", info.Size())
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			s.reply("501 bad offset")
+			return true
+		}
+		s.offset = offset
+		s.reply("350 restarting at %d", offset)
+	case "RETR":
+		s.retr(arg)
+	case "STOR":
+		s.stor(arg)
+	case "DELE":
+		if err := os.Remove(s.srv.local(arg)); err != nil {
+			s.reply("550 %v", err)
+			return true
+		}
+		s.reply("250 deleted")
+	case "RNFR":
+		s.renameFr = arg
+		s.reply("350 ready for RNTO")
+	case "RNTO":
+		if err := os.Rename(s.srv.local(s.renameFr), s.srv.local(arg)); err != nil {
+			s.reply("550 %v", err)
+			return true
+		}
+		s.reply("250 renamed")
+	case "MKD":
+		if err := os.Mkdir(s.srv.local(arg), 0755); err != nil {
+			s.reply("550 %v", err)
+			return true
+		}
+		s.reply(`257 "%s" created`, arg)
+	case "HASH":
+		sum, err := s.hash(s.hashAlg, arg)
+		if err != nil {
+			s.reply("550 %v", err)
+			return true
+		}
+		info, _ := os.Stat(s.srv.local(arg))
+		s.reply("213 %s 0-%d %s %s", s.hashAlg, info.Size(), sum, arg)
+	case "XMD5":
+		s.replyHash("MD5", arg)
+	case "XCRC":
+		s.replyHash("CRC32", arg)
+	case "XSHA256":
+		s.replyHash("SHA-256", arg)
+	case "QUIT":
+		s.reply("221 bye")
+		return false
+	default:
+		s.reply("502 %s not implemented", verb)
+	}
+	return true
+}
+
+func (s *testFTPSession) hash(alg, name string) (string, error) {
+	data, err := os.ReadFile(s.srv.local(name))
+	if err != nil {
+		return "", err
+	}
+	switch alg {
+	case "MD5":
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:]), nil
+	case "CRC32":
+		return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)), nil
+	case "SHA-256":
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unknown algorithm %q", alg)
+}
+
+func (s *testFTPSession) replyHash(alg, name string) {
+	sum, err := s.hash(alg, name)
+	if err != nil {
+		s.reply("550 %v", err)
+		return
+	}
+	s.reply("250 %s", sum)
+}
+
+func (s *testFTPSession) listenPassive() error {
+	if s.passive != nil {
+		s.passive.Close()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.passive = l
+	return nil
+}
+
+// dataConn accepts the pending passive data connection.
+func (s *testFTPSession) dataConn() (net.Conn, error) {
+	if s.passive == nil {
+		return nil, fmt.Errorf("no passive listener")
+	}
+	defer func() {
+		s.passive.Close()
+		s.passive = nil
+	}()
+	c, err := s.passive.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if s.protData {
+		c = tls.Server(c, s.srv.tlsConfig)
+	}
+	return c, nil
+}
+
+func (s *testFTPSession) list(arg string) {
+	entries, err := os.ReadDir(s.srv.local(arg))
+	if err != nil {
+		s.reply("550 %v", err)
+		return
+	}
+	s.reply("150 listing")
+	c, err := s.dataConn()
+	if err != nil {
+		s.reply("425 %v", err)
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		kind := "file"
+		if info.IsDir() {
+			kind = "dir"
+		}
+		fmt.Fprintf(c, "type=%s;size=%d;modify=%s; %s\r\n", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"), info.Name())
+	}
+	c.Close()
+	s.reply("226 done")
+}
+
+func (s *testFTPSession) retr(arg string) {
+	offset := s.offset
+	s.offset = 0
+	f, err := os.Open(s.srv.local(arg))
+	if err != nil {
+		s.reply("550 %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		s.reply("550 %v", err)
+		return
+	}
+	s.reply("150 sending")
+	c, err := s.dataConn()
+	if err != nil {
+		s.reply("425 %v", err)
+		return
+	}
+	io.Copy(c, f)
+	c.Close()
+	s.reply("226 done")
+}
+
+func (s *testFTPSession) stor(arg string) {
+	s.reply("150 receiving")
+	c, err := s.dataConn()
+	if err != nil {
+		s.reply("425 %v", err)
+		return
+	}
+	f, err := os.Create(s.srv.local(arg))
+	if err != nil {
+		c.Close()
+		s.reply("550 %v", err)
+		return
+	}
+	io.Copy(f, c)
+	f.Close()
+	c.Close()
+	s.reply("226 done")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies accepted in the hostkey_policy field.
+const (
+	hostKeyStrict   = "strict"   // key must be in known_hosts or match the pinned fingerprint
+	hostKeyTOFU     = "tofu"     // unknown hosts are trusted once and written to the managed known_hosts
+	hostKeyInsecure = "insecure" // no verification at all
+)
+
+// managedKnownHosts is the known_hosts file written by the tofu policy.
+var managedKnownHosts = "keys/known_hosts"
+
+var knownHostsMu sync.Mutex
+
+var errHostKeyMismatch = errors.New("host key mismatch")
+
+// validateHostKey checks the host key options of connections that use SSH.
+func validateHostKey(conn Connection) error {
+	switch conn.HostKeyPolicy {
+	case "", hostKeyTOFU, hostKeyInsecure:
+	case hostKeyStrict:
+		if conn.KnownHosts == "" && conn.HostKeyFingerprint == "" {
+			return fmt.Errorf("strict hostkey_policy requires known_hosts or hostkey_fingerprint for %s", conn.Name)
+		}
+	default:
+		return fmt.Errorf("invalid hostkey_policy for %s: %s", conn.Name, conn.HostKeyPolicy)
+	}
+	if conn.HostKeyFingerprint != "" && !strings.HasPrefix(conn.HostKeyFingerprint, "SHA256:") {
+		return fmt.Errorf("hostkey_fingerprint must be a SHA256 fingerprint for %s", conn.Name)
+	}
+	return nil
+}
+
+// hostKeyPolicy returns the effective policy of conn. Pinned fingerprints and
+// explicit known_hosts files are strict unless configured otherwise, all other
+// connections trust on first use.
+func hostKeyPolicy(conn Connection) string {
+	if conn.HostKeyPolicy != "" {
+		return conn.HostKeyPolicy
+	}
+	if conn.HostKeyFingerprint != "" || conn.KnownHosts != "" {
+		return hostKeyStrict
+	}
+	return hostKeyTOFU
+}
+
+// hostKeyCallback builds the host key verification for an SSH connection.
+func hostKeyCallback(conn Connection) (ssh.HostKeyCallback, error) {
+	policy := hostKeyPolicy(conn)
+	if policy == hostKeyInsecure {
+		logger.Warnf("Host key verification is disabled for %s\n", conn.Name)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	// A pinned fingerprint is checked first; with known_hosts also set the
+	// key has to pass both
+	pinned := func(hostname string, key ssh.PublicKey) error {
+		if conn.HostKeyFingerprint == "" {
+			return nil
+		}
+		got := ssh.FingerprintSHA256(key)
+		if got != conn.HostKeyFingerprint {
+			return fmt.Errorf("%w for %s: got %s, expected pinned %s", errHostKeyMismatch, hostname, got, conn.HostKeyFingerprint)
+		}
+		return nil
+	}
+	if conn.HostKeyFingerprint != "" && conn.KnownHosts == "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return pinned(hostname, key)
+		}, nil
+	}
+
+	var files []string
+	if conn.KnownHosts != "" {
+		files = append(files, conn.KnownHosts)
+	}
+	if policy == hostKeyTOFU {
+		if err := ensureFile(managedKnownHosts); err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts: %v", err)
+		}
+		files = append(files, managedKnownHosts)
+	}
+
+	knownHostsMu.Lock()
+	check, err := knownhosts.New(files...)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %v", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := pinned(hostname, key); err != nil {
+			return err
+		}
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			want := make([]string, 0, len(keyErr.Want))
+			for _, known := range keyErr.Want {
+				want = append(want, fmt.Sprintf("%s %s (%s:%d)", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+			}
+			return fmt.Errorf("%w for %s: got %s %s, expected %s", errHostKeyMismatch, hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(want, ", "))
+		}
+		if policy != hostKeyTOFU {
+			return fmt.Errorf("host key for %s is not in known_hosts: %s %s", hostname, key.Type(), ssh.FingerprintSHA256(key))
+		}
+		logger.Warnf("Trusting new host key for %s on first use: %s %s\n", hostname, key.Type(), ssh.FingerprintSHA256(key))
+		return appendKnownHost(managedKnownHosts, hostname, key)
+	}, nil
+}
+
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts: %v", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+func ensureFile(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	srv.start(t)
+	setupTestDB(t)
+
+	managedKnownHosts = filepath.Join(t.TempDir(), "keys", "known_hosts")
+	conn := Connection{Name: "tofu", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass"}
+
+	fm := &ManagerSFTP{}
+	if err := connectManager(fm, conn); err != nil {
+		t.Fatalf("First connection failed: %v", err)
+	}
+	fm.close()
+
+	data, err := os.ReadFile(managedKnownHosts)
+	if err != nil || !strings.Contains(string(data), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(srv.hostKey.PublicKey())))) {
+		t.Fatalf("Expected host key to be written to managed known_hosts, got %q (err: %v)", data, err)
+	}
+
+	// Replace the trusted key to simulate a server whose key changed
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostPort("127.0.0.1", srv.port()))}, otherSigner.PublicKey())
+	if err := os.WriteFile(managedKnownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to rewrite known_hosts: %v", err)
+	}
+
+	fm = &ManagerSFTP{}
+	err = connectManager(fm, conn)
+	if !errors.Is(err, errHostKeyMismatch) {
+		fm.close()
+		t.Fatalf("Expected host key mismatch, got %v", err)
+	}
+
+	connErrors, err := listConnectionErrors(db.conn)
+	if err != nil || len(connErrors) != 1 || connErrors[0].ServerName != "tofu" {
+		t.Errorf("Expected mismatch to be recorded against the connection, got %v (err: %v)", connErrors, err)
+	}
+}
+
+func TestHostKeyPinnedFingerprint(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	srv.start(t)
+	setupTestDB(t)
+
+	conn := Connection{
+		Name:               "pinned",
+		Host:               "127.0.0.1",
+		Port:               srv.port(),
+		Username:           "user",
+		Password:           "pass",
+		HostKeyFingerprint: ssh.FingerprintSHA256(srv.hostKey.PublicKey()),
+	}
+	if err := validateSSH(conn); err != nil {
+		t.Fatalf("validateSSH failed: %v", err)
+	}
+
+	fm := &ManagerSFTP{}
+	if err := connectManager(fm, conn); err != nil {
+		t.Fatalf("Connection with pinned fingerprint failed: %v", err)
+	}
+	fm.close()
+
+	conn.HostKeyFingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	fm = &ManagerSFTP{}
+	if err := connectManager(fm, conn); !errors.Is(err, errHostKeyMismatch) {
+		fm.close()
+		t.Errorf("Expected host key mismatch for wrong fingerprint, got %v", err)
+	}
+}
+
+func TestHostKeyStrictUnknownHost(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	srv.start(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	conn := Connection{Name: "strict", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass", KnownHosts: knownHosts}
+
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err == nil || !strings.Contains(err.Error(), "not in known_hosts") {
+		fm.close()
+		t.Errorf("Expected unknown host to be rejected, got %v", err)
+	}
+}
+
+func TestHostKeyFingerprintAndKnownHosts(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	srv.start(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	conn := Connection{
+		Name:               "both",
+		Host:               "127.0.0.1",
+		Port:               srv.port(),
+		Username:           "user",
+		Password:           "pass",
+		KnownHosts:         knownHosts,
+		HostKeyFingerprint: ssh.FingerprintSHA256(srv.hostKey.PublicKey()),
+	}
+
+	// The pin matches but known_hosts does not list the host
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err == nil || !strings.Contains(err.Error(), "not in known_hosts") {
+		fm.close()
+		t.Fatalf("Expected known_hosts to be checked as well, got %v", err)
+	}
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostPort("127.0.0.1", srv.port()))}, srv.hostKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	fm = &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("Expected a key passing both checks to be accepted: %v", err)
+	}
+	fm.close()
+}
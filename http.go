@@ -28,6 +28,7 @@ func handleHTTP(port int) {
 	// Define handlers
 	mux.HandleFunc("/info", getInfoFromDB)
 	mux.HandleFunc("/connections", getConnections)
+	mux.HandleFunc("/errors", getConnectionErrors)
 	mux.HandleFunc("/health", healthCheck)
 	mux.HandleFunc("/deleteOldEntries", handleDelete)
 	mux.HandleFunc("/truncateDatabase", handleTruncate)
@@ -158,7 +159,7 @@ func getInfoFromDB(w http.ResponseWriter, r *http.Request) {
 	offset := (page - 1) * limit
 
 	// Update query with pagination
-	rows, err := db.Query("SELECT file_name, file_size, download_time, server_name FROM downloaded_files ORDER BY download_time DESC LIMIT ? OFFSET ?", limit, offset)
+	rows, err := db.Query("SELECT file_name, file_size, download_time, server_name, direction, checksum, post_action, post_action_path FROM downloaded_files ORDER BY download_time DESC LIMIT ? OFFSET ?", limit, offset)
 	if err != nil {
 		logger.Printf("Error querying database: %v", err)
 		http.Error(w, "Failed to query database", http.StatusInternalServerError)
@@ -169,7 +170,7 @@ func getInfoFromDB(w http.ResponseWriter, r *http.Request) {
 	var files []DownloadedFile
 	for rows.Next() {
 		var file DownloadedFile
-		if err := rows.Scan(&file.FileName, &file.FileSize, &file.DownloadTime, &file.ServerName); err != nil {
+		if err := rows.Scan(&file.FileName, &file.FileSize, &file.DownloadTime, &file.ServerName, &file.Direction, &file.Checksum, &file.PostAction, &file.PostActionPath); err != nil {
 			logger.Printf("Error scanning row: %v", err)
 			http.Error(w, "Failed to scan row", http.StatusInternalServerError)
 			return
@@ -211,3 +212,24 @@ func getConnections(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(Connections)
 }
+
+// Handler to get the last security errors recorded per connection
+func getConnectionErrors(w http.ResponseWriter, r *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		logger.Printf("Error opening database: %v", err)
+		http.Error(w, "Failed to open database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	connErrors, err := listConnectionErrors(db)
+	if err != nil {
+		logger.Printf("Error querying connection errors: %v", err)
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connErrors)
+}
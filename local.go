@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManagerLocal sweeps a directory on the local host, typically an NFS or CIFS
+// mount, with the same traversal as the network backends.
+type ManagerLocal struct{}
+
+func (fm *ManagerLocal) connect(conn Connection) error {
+	// A missing or unmounted path is reported like an unreachable server
+	info, err := os.Stat(conn.Path)
+	if err != nil {
+		return fmt.Errorf("failed to access local path: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local path is not a directory: %s", conn.Path)
+	}
+	logger.Debugf("Connected to local path: %s\n", conn.Path)
+	return nil
+}
+
+func (fm *ManagerLocal) readDir(remotePath string) ([]RemoteEntry, error) {
+	files, err := os.ReadDir(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %v", err)
+	}
+	entries := make([]RemoteEntry, 0, len(files))
+	for _, file := range files {
+		// os.Stat follows symbolic links like the SFTP backend does
+		info, err := os.Stat(filepath.Join(remotePath, file.Name()))
+		if err != nil {
+			logger.Debugf("Error getting file info: %v\n", err)
+			continue
+		}
+		entry := entryFromFileInfo(info)
+		entry.Name = file.Name()
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (fm *ManagerLocal) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	srcFile, err := os.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+		srcFile.Close()
+		return nil, fmt.Errorf("error seeking in source file: %v", err)
+	}
+	return srcFile, nil
+}
+
+func (fm *ManagerLocal) deleteFile(remotePath string) error {
+	return os.Remove(remotePath)
+}
+
+func (fm *ManagerLocal) rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (fm *ManagerLocal) makeDir(remotePath string) error {
+	return os.MkdirAll(remotePath, os.ModePerm)
+}
+
+func (fm *ManagerLocal) writeFile(remotePath string, r io.Reader) error {
+	dstFile, err := os.Create(remotePath)
+	if err != nil {
+		return fmt.Errorf("error creating destination file: %v", err)
+	}
+	if _, err := io.Copy(dstFile, r); err != nil {
+		dstFile.Close()
+		return fmt.Errorf("error copying file: %v", err)
+	}
+	return dstFile.Close()
+}
+
+func (fm *ManagerLocal) stat(remotePath string) (RemoteEntry, error) {
+	info, err := os.Stat(remotePath)
+	if err != nil {
+		return RemoteEntry{}, err
+	}
+	return entryFromFileInfo(info), nil
+}
+
+// Local files need no connection, so workers share the manager.
+func (fm *ManagerLocal) concurrentSafe() {}
+
+func (fm *ManagerLocal) close() error {
+	return nil
+}
+
+func init() {
+	registerBackend("local", Backend{
+		New: func() Manager { return &ManagerLocal{} },
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalSweep(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	for name, content := range map[string]string{
+		"top.txt":       "top",
+		"a/mid.txt":     "mid",
+		"a/b/deep.txt":  "deep",
+		"a/ignored.bin": "bin",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	conn := Connection{
+		Name:     "local_test",
+		Protocol: "local",
+		Path:     src,
+		Depth:    2,
+		Regex:    "\\.txt$",
+		Separate: true,
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerLocal{})
+
+	dest := filepath.Join(download_folder, "local_test")
+	for _, name := range []string{"top.txt", "a/mid.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("Expected %s to be picked up: %v", name, err)
+		}
+	}
+	for _, name := range []string{"a/b/deep.txt", "a/ignored.bin"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be skipped", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(src, "top.txt")); err != nil {
+		t.Errorf("Expected source to be kept when remove is false: %v", err)
+	}
+
+	// A second sweep must rely on the database and not copy the file again
+	if err := os.Remove(filepath.Join(dest, "top.txt")); err != nil {
+		t.Fatalf("Failed to remove local copy: %v", err)
+	}
+	handleDownload(conn, &ManagerLocal{})
+	if _, err := os.Stat(filepath.Join(dest, "top.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected already downloaded file to be skipped")
+	}
+
+	conn.Remove = true
+	if err := os.WriteFile(filepath.Join(src, "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	handleDownload(conn, &ManagerLocal{})
+	if _, err := os.Stat(filepath.Join(src, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected source file to be removed after pickup")
+	}
+}
+
+func TestLocalConnectMissingPath(t *testing.T) {
+	fm := &ManagerLocal{}
+	if err := fm.connect(Connection{Name: "missing", Path: filepath.Join(t.TempDir(), "nope")}); err == nil {
+		t.Errorf("Expected error for missing local path")
+	}
+}
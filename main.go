@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/textproto"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
-	"regexp"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -36,7 +43,7 @@ type Connection struct {
 	Port       int    `yaml:"port"`
 	Protocol   string `yaml:"protocol"`
 	Username   string `yaml:"username"`
-	Password   string `yaml:"password"`
+	Password   string `yaml:"password" json:"-"`
 	Delay      int    `yaml:"delay"`
 	Path       string `yaml:"path"`
 	Depth      int    `yaml:"depth"`
@@ -45,10 +52,122 @@ type Connection struct {
 	Status     bool   `yaml:"status,omitempty" default:"false"`
 	Separate   bool   `yaml:"separate" default:"false"`
 	Remove     bool   `yaml:"remove" default:"true"`
+
+	// TLS options used by the ftps and ftps-implicit protocols
+	TLSCAFile     string `yaml:"tls_ca_file"`
+	TLSCertFile   string `yaml:"tls_cert_file"`
+	TLSKeyFile    string `yaml:"tls_key_file"`
+	TLSServerName string `yaml:"tls_server_name"`
+	TLSMinVersion string `yaml:"tls_min_version"`
+
+	// Object storage options used by the s3 protocol
+	Endpoint     string `yaml:"endpoint"`
+	Bucket       string `yaml:"bucket"`
+	Region       string `yaml:"region"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key" json:"-"`
+	SessionToken string `yaml:"session_token" json:"-"`
+
+	// SSH authentication for the sftp and ftpoverssh protocols
+	SSHKeyPassphrase string   `yaml:"sshkeypassphrase" json:"-"`
+	SSHCertPath      string   `yaml:"sshcertpath"`
+	SSHAgent         bool     `yaml:"sshagent"`
+	AuthMethods      []string `yaml:"auth_methods"`
+
+	// Jump hosts the SSH connection is made through, in order
+	Jump []Connection `yaml:"jump"`
+
+	// FTP server inside the SSH tunnel for the ftpoverssh protocol
+	FTPHost     string `yaml:"ftp_host"`
+	FTPPort     int    `yaml:"ftp_port"`
+	FTPUsername string `yaml:"ftp_username"`
+	FTPPassword string `yaml:"ftp_password" json:"-"`
+
+	// Proxy URL (socks5:// or http://), or "direct" to bypass the global
+	// proxy. It may hold credentials, so it is not served by /connections.
+	Proxy string `yaml:"proxy" json:"-"`
+
+	// Host key verification for the sftp and ftpoverssh protocols
+	KnownHosts         string `yaml:"known_hosts"`
+	HostKeyFingerprint string `yaml:"hostkey_fingerprint"`
+	HostKeyPolicy      string `yaml:"hostkey_policy"`
+
+	// Upload mode: walk LocalPath and deliver matching files into Path
+	Direction    string `yaml:"direction"`
+	LocalPath    string `yaml:"local_path"`
+	LocalArchive string `yaml:"local_archive"`
+
+	// Checksum verification of downloads: sha256, md5 or crc32, taken from
+	// the server or a <file>.<algorithm> sidecar
+	Checksum       string `yaml:"checksum"`
+	ChecksumSource string `yaml:"checksum_source"`
+
+	// Stability policy: only pick up files whose size and modification time
+	// were unchanged for StableListings listings and StableFor seconds
+	StableListings int `yaml:"stable_listings"`
+	StableFor      int `yaml:"stable_for"`
+
+	// File selection on top of Regex: globs matched against the name, or the
+	// relative path when they contain a slash, a regex against the relative
+	// path, size in bytes and age in seconds. LastRunMargin in seconds
+	// allows for clock skew and late writes with NewerThanLastRun
+	Include          []string `yaml:"include"`
+	Exclude          []string `yaml:"exclude"`
+	PathRegex        string   `yaml:"path_regex"`
+	MinSize          int64    `yaml:"min_size"`
+	MaxSize          int64    `yaml:"max_size"`
+	MinAge           int      `yaml:"min_age"`
+	MaxAge           int      `yaml:"max_age"`
+	NewerThanLastRun bool     `yaml:"newer_than_last_run"`
+	LastRunMargin    int      `yaml:"last_run_margin"`
+	SkipHidden       bool     `yaml:"skip_hidden"`
+
+	// What happens to a source file on the server after its download:
+	// none, delete (same as Remove), archive into ArchiveDir, optionally in
+	// ArchiveDateFormat date folders, or rename with RenameSuffix
+	PostAction        string `yaml:"post_action"`
+	ArchiveDir        string `yaml:"archive_dir"`
+	ArchiveDateFormat string `yaml:"archive_date_format"`
+	RenameSuffix      string `yaml:"rename_suffix"`
+
+	// Local layout of downloads below the download folder, e.g.
+	// "{connection}/{yyyy}/{mm}/{dd}/{name}"; the remote tree is mirrored
+	// when empty
+	Destination string `yaml:"destination"`
+
+	// Marker files: a data file is only picked up once <file><Marker>
+	// exists, and a folder only once BatchMarker exists in it. MarkerAction
+	// is keep, download or delete.
+	Marker       string `yaml:"marker"`
+	BatchMarker  string `yaml:"batch_marker"`
+	MarkerAction string `yaml:"marker_action"`
+
+	// Number of files transferred at once over this connection
+	Concurrency int `yaml:"concurrency"`
+
+	// Bandwidth limit in bytes per second, e.g. "2MB", with optional
+	// time-of-day windows that override it
+	RateLimit    string       `yaml:"rate_limit"`
+	RateSchedule []RateWindow `yaml:"rate_schedule"`
+
+	// Files of at least SegmentThreshold bytes are fetched in Segments
+	// parallel byte ranges, on backends that support it
+	SegmentThreshold int64 `yaml:"segment_threshold"`
+	Segments         int   `yaml:"segments"`
+
+	// Atomic delivery: where downloads are written before being renamed
+	Delivery   string `yaml:"delivery"`
+	StagingDir string `yaml:"staging_dir"`
 }
 
 type Config struct {
 	Connections []Connection `yaml:"connections"`
+	Routes      []Route      `yaml:"routes"`
+	Proxy       string       `yaml:"proxy"`
+
+	// Bandwidth cap shared by all connections
+	RateLimit    string       `yaml:"rate_limit"`
+	RateSchedule []RateWindow `yaml:"rate_schedule"`
 }
 
 type ManagerSFTP struct {
@@ -58,10 +177,25 @@ type ManagerSFTP struct {
 
 type ManagerFTP struct {
 	ftpConn *ftp.ServerConn
+	tlsMode ftpTLSMode
+
+	// openCommand opens an extra control connection for commands the FTP
+	// library has no API for; cmdConn is kept open until close
+	openCommand func() (*ftpCommandConn, error)
+	cmdConn     *ftpCommandConn
 }
 
+// ftpTLSMode selects how ManagerFTP secures the control and data connections.
+type ftpTLSMode int
+
+const (
+	ftpTLSNone     ftpTLSMode = iota
+	ftpTLSExplicit            // AUTH TLS on the plain control connection
+	ftpTLSImplicit            // TLS from the first byte, usually port 990
+)
+
 type ManagerFTPoverSSH struct {
-	ftpConn *ftp.ServerConn
+	ManagerFTP
 	sshConn *ssh.Client
 }
 
@@ -74,13 +208,66 @@ type DB struct {
 	mu   sync.Mutex
 }
 
+// EntryKind tells files, folders and links apart in a RemoteEntry.
+type EntryKind int
+
+const (
+	EntryFile EntryKind = iota
+	EntryFolder
+	EntryLink
+	EntryOther
+)
+
+func (k EntryKind) String() string {
+	switch k {
+	case EntryFile:
+		return "file"
+	case EntryFolder:
+		return "folder"
+	case EntryLink:
+		return "link"
+	default:
+		return "other"
+	}
+}
+
+// RemoteEntry is a protocol-neutral directory entry returned by Manager.readDir.
+type RemoteEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Kind    EntryKind
+}
+
+func (e RemoteEntry) IsDir() bool {
+	return e.Kind == EntryFolder
+}
+
+// Manager is implemented by every protocol backend. The shared download
+// engine only talks to remote servers through this interface.
 type Manager interface {
 	connect(conn Connection) error
-	downloadFile(remotePath, localPath string) error
+	readDir(remotePath string) ([]RemoteEntry, error)
+	// openFile opens remotePath for reading starting at offset. Backends that
+	// cannot start in the middle of a file return errResumeNotSupported.
+	openFile(remotePath string, offset int64) (io.ReadCloser, error)
 	deleteFile(remotePath string) error
-	readDir(remotePath string) ([]*ftp.Entry, error)
+	close() error
+}
+
+// uploader is implemented by backends that can also receive files, which is
+// required for connections with direction: upload.
+type uploader interface {
+	Manager
+	// makeDir creates remotePath and any missing parents.
+	makeDir(remotePath string) error
+	writeFile(remotePath string, r io.Reader) error
+	stat(remotePath string) (RemoteEntry, error)
 }
 
+var errResumeNotSupported = errors.New("resume is not supported")
+
 var db DB
 
 var Connections = SplittedConnections{}
@@ -115,25 +302,70 @@ func readConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("error parsing YAML: %v", err)
 	}
 
+	if err := validateProxy("global proxy", config.Proxy); err != nil {
+		return Config{}, err
+	}
+	if err := validateRateLimit("global rate limit", config.RateLimit, config.RateSchedule); err != nil {
+		return Config{}, err
+	}
+
 	// Validate the fields
-	for _, conn := range config.Connections {
+	for i := range config.Connections {
+		// Connections without their own proxy use the global one
+		if config.Connections[i].Proxy == "" {
+			config.Connections[i].Proxy = config.Proxy
+		}
+		conn := config.Connections[i]
 		if conn.Name == "" {
 			return Config{}, fmt.Errorf("connection name is missing")
 		}
-		if conn.Host == "" {
-			return Config{}, fmt.Errorf("connection host is missing for %s", conn.Name)
+		if err := validateProxy(conn.Name, conn.Proxy); err != nil {
+			return Config{}, err
 		}
-		if conn.Port <= 0 || conn.Port > 65535 {
-			return Config{}, fmt.Errorf("invalid port number for %s: %d", conn.Name, conn.Port)
+		backend, ok := lookupBackend(conn.Protocol)
+		if !ok {
+			return Config{}, fmt.Errorf("unsupported protocol for %s: %s (supported: %s)", conn.Name, conn.Protocol, strings.Join(registeredProtocols(), ", "))
 		}
-		if conn.Protocol != "sftp" && conn.Protocol != "ftp" && conn.Protocol != "ftpoverssh" {
-			return Config{}, fmt.Errorf("unsupported protocol for %s: %s", conn.Name, conn.Protocol)
+		if backend.Validate != nil {
+			if err := backend.Validate(conn); err != nil {
+				return Config{}, err
+			}
+		}
+		switch conn.Direction {
+		case "", directionDownload:
+		case directionUpload:
+			if conn.LocalPath == "" {
+				return Config{}, fmt.Errorf("local_path is missing for %s", conn.Name)
+			}
+			if _, ok := backend.New().(uploader); !ok {
+				return Config{}, fmt.Errorf("protocol %s does not support uploads for %s", conn.Protocol, conn.Name)
+			}
+			if conn.Remove && conn.LocalArchive != "" {
+				return Config{}, fmt.Errorf("remove and local_archive are mutually exclusive for %s", conn.Name)
+			}
+		default:
+			return Config{}, fmt.Errorf("invalid direction for %s: %s", conn.Name, conn.Direction)
+		}
+		if err := validateDelivery(conn); err != nil {
+			return Config{}, err
+		}
+		if err := validateChecksum(conn); err != nil {
+			return Config{}, err
 		}
-		if conn.Username == "" {
-			return Config{}, fmt.Errorf("username is missing for %s", conn.Name)
+		if err := validateStability(conn); err != nil {
+			return Config{}, err
 		}
-		if conn.Password == "" {
-			return Config{}, fmt.Errorf("password is missing for %s", conn.Name)
+		if err := validateMarkers(conn); err != nil {
+			return Config{}, err
+		}
+		if err := validateFilters(conn); err != nil {
+			return Config{}, err
+		}
+		if err := validatePostAction(conn); err != nil {
+			return Config{}, err
+		}
+		if err := validateDestination(conn); err != nil {
+			return Config{}, err
 		}
 		if conn.Delay < 0 {
 			return Config{}, fmt.Errorf("invalid delay for %s: %d", conn.Name, conn.Delay)
@@ -144,9 +376,22 @@ func readConfig(path string) (Config, error) {
 		if conn.Depth < 0 {
 			return Config{}, fmt.Errorf("invalid depth for %s: %d", conn.Name, conn.Depth)
 		}
+		if conn.Concurrency < 0 || conn.Concurrency > maxConcurrency {
+			return Config{}, fmt.Errorf("invalid concurrency for %s: %d (maximum %d)", conn.Name, conn.Concurrency, maxConcurrency)
+		}
+		if err := validateSegments(conn); err != nil {
+			return Config{}, err
+		}
+		if err := validateRateLimit(conn.Name, conn.RateLimit, conn.RateSchedule); err != nil {
+			return Config{}, err
+		}
 
 	}
 
+	if err := validateRoutes(config); err != nil {
+		return Config{}, err
+	}
+
 	return config, nil
 }
 
@@ -230,397 +475,341 @@ func bytesToHumanReadable(bytes int64) string {
 	}
 }
 
-func resumableDownload(fm *ManagerSFTP, remoteFilePath, localFilePath string) error {
-	srcFile, err := fm.sftpClient.Open(remoteFilePath)
+// resumableDownload downloads remoteFilePath to localFilePath through a
+// .part file chosen by the delivery mode of conn. An interrupted download is
+// resumed on the next attempt if the remote file is unchanged, and the .part
+// file is synced, verified and renamed to localFilePath once it holds the
+// whole file.
+func resumableDownload(fm Manager, conn Connection, file RemoteEntry, remoteFilePath, localFilePath string) (fileChecksum, error) {
+	partPath, metaPath := partPaths(conn, localFilePath)
+	meta := newPartMeta(conn, file, remoteFilePath)
+	if err := os.MkdirAll(filepath.Dir(partPath), os.ModePerm); err != nil {
+		return fileChecksum{}, fmt.Errorf("error creating staging directory: %v", err)
+	}
+
+	// Calculate the download time
+	startTime := time.Now()
+
+	var err error
+	if rr, ok := fm.(rangeReader); ok && useSegments(conn, file) {
+		err = segmentedDownload(rr, conn, file, remoteFilePath, partPath, metaPath, meta)
+	} else {
+		err = streamDownload(fm, conn, file, remoteFilePath, partPath, metaPath, meta)
+	}
 	if err != nil {
-		return fmt.Errorf("error opening source file: %v", err)
+		return fileChecksum{}, err
 	}
-	defer srcFile.Close()
 
-	fileInfo, err := srcFile.Stat()
+	sum, err := verifyChecksum(fm, conn, remoteFilePath, partPath)
 	if err != nil {
-		return fmt.Errorf("error getting file info: %v", err)
+		removePart(partPath, metaPath)
+		return sum, err
+	}
+	if err := moveIntoPlace(partPath, localFilePath); err != nil {
+		return fileChecksum{}, fmt.Errorf("error renaming partial file: %v", err)
 	}
-	totalSize := fileInfo.Size()
+	syncDir(filepath.Dir(localFilePath))
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("Error deleting partial file metadata: %v\n", err)
+	}
+
+	downloadTime := time.Since(startTime)
+	logger.Infof("Downloaded file: %s (Size: %s) in %v\n", path.Base(remoteFilePath), bytesToHumanReadable(file.Size), downloadTime)
 
+	return sum, nil
+}
+
+// streamDownload copies the remote file into partPath in one stream,
+// continuing after the data of an earlier attempt when possible.
+func streamDownload(fm Manager, conn Connection, file RemoteEntry, remoteFilePath, partPath, metaPath string, meta partMeta) error {
 	var dstFile *os.File
-	var startPos int64 = 0
 
-	// Check if partial file exists
-	if info, err := os.Stat(localFilePath); err == nil {
-		startPos = info.Size()
-		dstFile, err = os.OpenFile(localFilePath, os.O_APPEND|os.O_WRONLY, 0644)
+	// Check if a partial file of the same remote file exists
+	startPos := resumeOffset(partPath, metaPath, meta)
+
+	srcFile, err := fm.openFile(remoteFilePath, startPos)
+	if errors.Is(err, errResumeNotSupported) {
+		logger.Debugf("Resume is not supported, restarting download of %s\n", remoteFilePath)
+		startPos = 0
+		srcFile, err = fm.openFile(remoteFilePath, startPos)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening source file: %v", err)
+	}
+	defer srcFile.Close()
+
+	if startPos > 0 {
+		dstFile, err = os.OpenFile(partPath, os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = dstFile.Seek(startPos, io.SeekStart)
+		}
 		if err != nil {
 			return fmt.Errorf("error opening existing file: %v", err)
 		}
 		logger.Infof("Resuming download from position %d", startPos)
 	} else {
-		dstFile, err = os.Create(localFilePath)
+		if err := writePartMeta(metaPath, meta); err != nil {
+			return fmt.Errorf("error writing partial file metadata: %v", err)
+		}
+		dstFile, err = os.Create(partPath)
 		if err != nil {
 			return fmt.Errorf("error creating destination file: %v", err)
 		}
 	}
 	defer dstFile.Close()
 
-	// Seek to the start position in both files
-	_, err = srcFile.Seek(startPos, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("error seeking in source file: %v", err)
-	}
-
-	_, err = dstFile.Seek(startPos, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("error seeking in destination file: %v", err)
-	}
-
-	// Calculate the download time
-	startTime := time.Now()
-
 	// Copy the file contents from the remote file to the local file
-	_, err = io.Copy(dstFile, srcFile)
+	written, err := io.Copy(dstFile, throttle(conn, srcFile))
 	if err != nil {
 		return fmt.Errorf("error copying file: %v", err)
 	}
+	// Finish the transfer before the connection is used for verification
+	srcFile.Close()
 
-	downloadTime := time.Since(startTime)
-	logger.Infof("Downloaded file: %s (Size: %s) in %v\n", path.Base(remoteFilePath), bytesToHumanReadable(totalSize), downloadTime)
-
-	return nil
-}
-
-func recursivelyDownloadSFTP(remotePath, localPath string, depth int, fm ManagerSFTP, conn Connection) error {
-	if depth == 0 {
-		return nil
+	// A short read leaves the .part file for the next attempt
+	if total := startPos + written; total != file.Size {
+		if total > file.Size {
+			removePart(partPath, metaPath)
+		}
+		return fmt.Errorf("file size mismatch for %s: expected %d, got %d", file.Name, file.Size, total)
 	}
-
-	// Read the directory contents from the remote SFTP server
-	files, err := fm.sftpClient.ReadDir(remotePath)
-	if err != nil {
-		return fmt.Errorf("error reading directory: %v", err)
+	if err := dstFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing destination file: %v", err)
 	}
-	for _, file := range files {
-		logger.Debugf("Found file: %s, Size: %s, IsDir: %t\n", file.Name(), bytesToHumanReadable(file.Size()), file.IsDir())
+	if err := dstFile.Close(); err != nil {
+		return fmt.Errorf("error closing destination file: %v", err)
 	}
-	for _, file := range files {
-		remoteFilePath := path.Join(remotePath, file.Name())
-		localFilePath := path.Join(localPath, file.Name())
-
-		if file.IsDir() {
-			// If the file is a directory, create the corresponding local directory
-			if _, err := os.Stat(localFilePath); os.IsNotExist(err) {
-				err := os.MkdirAll(localFilePath, os.ModePerm)
-				if err != nil {
-					logger.Debugf("Error creating directory: %v\n", err)
-					continue
-				}
-			}
-			// Recursively download the contents of the directory
-			err := recursivelyDownloadSFTP(remoteFilePath, localFilePath, depth-1, fm, conn)
-			if err != nil {
-				logger.Debugf("Error downloading directory: %v\n", err)
-				continue
-			}
-		} else {
-
-			// Check if the file matches the regex mask if regex is provided
-			matched := true
-			if conn.Regex != "" {
-				matched, err = regexp.MatchString(conn.Regex, file.Name())
-				if err != nil {
-					logger.Debugf("Error matching regex: %v\n", err)
-					continue
-				}
-			}
-
-			if !matched {
-				logger.Debugf("File does not match the regex mask: %s\n", file.Name())
-				continue
-			}
-			// Check if the file has already been downloaded
-			db.mu.Lock()
-			existingFiles, err := searchDownloadedFileEntries(db.conn, file.Name(), file.Size(), conn.Name)
-			db.mu.Unlock()
+	return nil
+}
 
-			if err != nil {
-				logger.Debugf("Error searching for existing file entries: %v\n", err)
-				continue
-			}
+func recursivelyDownload(remotePath, localPath string, depth int, fm Manager, conn Connection) error {
+	pool := newTransferPool(fm, conn)
+	filter := newFileFilter(conn, time.Now())
+	dest := newDestination(conn)
+	var batches markerBatches
+	var failed atomic.Bool
 
-			if len(existingFiles) > 0 {
-				logger.Warnf("File already downloaded: %s\n", file.Name())
-				continue
-			}
-			// If the file is not a directory, download the file
-			err = resumableDownload(&fm, remoteFilePath, localFilePath)
-			if err != nil {
-				logger.Debugf("Error downloading file: %v\n", err)
-				continue
-			}
+	err := walkRemote(fm, remotePath, "", depth, filter, func(file RemoteEntry, remoteFilePath, relPath string, dir []RemoteEntry) {
+		localFilePath, err := dest.localPath(localPath, file, relPath, time.Now())
+		if err != nil {
+			logger.Errorf("Error building local path: %v\n", err)
+			failed.Store(true)
+			return
+		}
 
-			// Check file sizes to ensure the download was successful
-			srcFileInfo, err := fm.sftpClient.Stat(remoteFilePath)
+		// Create the corresponding local directory
+		localDir := path.Dir(localFilePath)
+		if _, err := os.Stat(localDir); os.IsNotExist(err) {
+			err := os.MkdirAll(localDir, os.ModePerm)
 			if err != nil {
-				logger.Debugf("Error getting source file info: %v\n", err)
-				continue
+				logger.Debugf("Error creating directory: %v\n", err)
+				failed.Store(true)
+				return
 			}
-
-			dstFileInfo, err := os.Stat(localFilePath)
-			if err != nil {
-				logger.Debugf("Error getting destination file info: %v\n", err)
-				continue
+		}
+		if conn.BatchMarker != "" {
+			batches.add(conn, dir, file, remoteFilePath, localFilePath)
+		}
+		pool.submit(func(fm Manager) {
+			ok := downloadEntry(file, remoteFilePath, localFilePath, dir, fm, conn)
+			batches.done(remoteFilePath, ok)
+			if !ok {
+				failed.Store(true)
 			}
+		})
+	})
 
-			if srcFileInfo.Size() != dstFileInfo.Size() {
-				logger.Debugf("File size mismatch for %s: source size %d, destination size %d\n", file.Name(), srcFileInfo.Size(), dstFileInfo.Size())
-				// If the file sizes do not match, delete the local file
-				err = os.Remove(localFilePath)
-				if err != nil {
-					logger.Debugf("Error deleting invalid local file: %v\n", err)
-				} else {
-					logger.Debugf("Deleted invalid local file: %s\n", localFilePath)
-				}
-			} else {
-
-				logger.Debugf("File size match for %s: %d bytes\n", file.Name(), srcFileInfo.Size())
-
-				// If the file sizes match and Remove is true, delete the file from the server
-				if conn.Remove {
-					err = fm.sftpClient.Remove(remoteFilePath)
-					if err != nil {
-						logger.Errorf("Error deleting file from server: %v\n", err)
-					} else {
-						logger.Debugf("Deleted file from server: %s\n", remoteFilePath)
-					}
-				} else {
-					logger.Debugf("File not removed from server as per configuration: %s\n", remoteFilePath)
-				}
-
-				// Create a sample downloaded file entry
-				file := DownloadedFile{
-					FileName:     file.Name(),
-					ServerName:   conn.Name,
-					FileSize:     dstFileInfo.Size(),
-					DownloadTime: time.Now().Format("2006-01-02 15:04:05"),
-				}
-
-				// Save the downloaded file entry to the database
-				db.mu.Lock()
-				err = saveDownloadedFileEntry(db.conn, file)
-				db.mu.Unlock()
-				if err != nil {
-					logger.Fatalf("Failed to save file entry: %v", err)
-				}
-			}
-		}
+	// Batch markers are only finished once every file they release is done
+	pool.wait()
+	batches.finish(fm, conn)
+	if err == nil && !failed.Load() {
+		filter.finishRun()
 	}
-	return nil
+	return err
 }
 
-func recursivelyDownloadFTP(remotePath, localPath string, depth int, fm Manager, conn Connection) error {
+// walkRemote lists remotePath and its folders up to depth levels and calls
+// visit for every file selected by filter, along with the listing of its
+// folder. relPath is the path of remotePath relative to the folder the walk
+// started in. A nil filter selects every file. Folders that cannot be listed
+// are skipped and the first such error is returned once the walk is done.
+func walkRemote(fm Manager, remotePath, relPath string, depth int, filter *fileFilter, visit func(file RemoteEntry, remoteFilePath, relPath string, dir []RemoteEntry)) error {
 	if depth == 0 {
 		return nil
 	}
+	var walkErr error
 
+	// Read the directory contents from the remote server
 	files, err := fm.readDir(remotePath)
 	if err != nil {
 		return fmt.Errorf("error reading directory: %v", err)
 	}
 	for _, file := range files {
-		logger.Debugf("Found file: %s, Size: %s, IsDir: %t\n", file.Name, bytesToHumanReadable(int64(file.Size)), file.Type == ftp.EntryTypeFolder)
+		logger.Debugf("Found file: %s, Size: %s, IsDir: %t\n", file.Name, bytesToHumanReadable(file.Size), file.IsDir())
 	}
 
 	for _, file := range files {
 		remoteFilePath := path.Join(remotePath, file.Name)
-		localFilePath := path.Join(localPath, file.Name)
-
-		if file.Type == ftp.EntryTypeFolder {
-			// If the file is a directory, create the corresponding local directory
-			if _, err := os.Stat(localFilePath); os.IsNotExist(err) {
-				err := os.MkdirAll(localFilePath, os.ModePerm)
-				if err != nil {
-					logger.Debugf("Error creating directory: %v\n", err)
-					continue
-				}
-			}
-			// Recursively download the contents of the directory
-			err := recursivelyDownloadFTP(remoteFilePath, localFilePath, depth-1, fm, conn)
-			if err != nil {
-				logger.Debugf("Error downloading directory: %v\n", err)
-				continue
-			}
-		} else {
-
-			// Check if the file matches the regex mask if regex is provided
-			matched := true
-			if conn.Regex != "" {
-				matched, err = regexp.MatchString(conn.Regex, file.Name)
-				if err != nil {
-					logger.Debugf("Error matching regex: %v\n", err)
-					continue
-				}
-			}
+		relFilePath := path.Join(relPath, file.Name)
 
-			if !matched {
-				logger.Debugf("File does not match the regex mask: %s\n", file.Name)
+		switch file.Kind {
+		case EntryFolder:
+			if !filter.matchFolder(file.Name, remoteFilePath) {
 				continue
 			}
-			// Check if the file has already been downloaded
-			db.mu.Lock()
-			existingFiles, err := searchDownloadedFileEntries(db.conn, file.Name, int64(file.Size), conn.Name)
-			db.mu.Unlock()
-
-			if err != nil {
-				logger.Debugf("Error searching for existing file entries: %v\n", err)
-				continue
-			}
-
-			if len(existingFiles) > 0 {
-				logger.Warnf("File already downloaded: %s\n", file.Name)
-				continue
-			}
-
-			// Simulate downloading the file from the FTP server
-			err = fm.downloadFile(remoteFilePath, localFilePath)
-			if err != nil {
-				logger.Debugf("Error downloading file: %v\n", err)
-				continue
-			}
-
-			// Verify the file size to ensure the download was successful
-			localFileInfo, err := os.Stat(localFilePath)
+			// Recursively walk the contents of the directory
+			err := walkRemote(fm, remoteFilePath, relFilePath, depth-1, filter, visit)
 			if err != nil {
-				logger.Debugf("Error stating local file: %v\n", err)
+				logger.Debugf("Error downloading directory: %v\n", err)
+				if walkErr == nil {
+					walkErr = err
+				}
 				continue
 			}
-
-			if localFileInfo.Size() != int64(file.Size) {
-				logger.Debugf("File size mismatch for %s: expected %d, got %d\n", file.Name, file.Size, localFileInfo.Size())
-				// If the file sizes do not match, delete the local file
-				err = os.Remove(localFilePath)
-				if err != nil {
-					logger.Debugf("Error deleting invalid local file: %v\n", err)
-				} else {
-					logger.Debugf("Deleted invalid local file: %s\n", localFilePath)
-				}
-			} else {
-				// If the file sizes match and Remove is true, delete the file from the server
-				if conn.Remove {
-					err = fm.deleteFile(remoteFilePath)
-					if err != nil {
-						logger.Debugf("Error deleting file from server: %v\n", err)
-					} else {
-						logger.Debugf("Deleted file from server: %s\n", remoteFilePath)
-					}
-				} else {
-					logger.Debugf("File not removed from server as per configuration: %s\n", remoteFilePath)
-				}
-
-				// Create a sample downloaded file entry
-				downloadedFile := DownloadedFile{
-					FileName:     file.Name,
-					ServerName:   conn.Name,
-					FileSize:     int64(file.Size),
-					DownloadTime: time.Now().Format("2006-01-02 15:04:05"),
-				}
-
-				// Save the downloaded file entry to the database
-				db.mu.Lock()
-				err = saveDownloadedFileEntry(db.conn, downloadedFile)
-				db.mu.Unlock()
-				if err != nil {
-					logger.Fatalf("Failed to save file entry: %v", err)
-				}
-
+		case EntryFile:
+			if filter.matchFile(file, relFilePath) {
+				visit(file, remoteFilePath, relFilePath, files)
 			}
-
+		default:
+			logger.Debugf("Skipping entry of kind %s: %s\n", file.Kind, remoteFilePath)
 		}
 	}
-	return nil
+	return walkErr
 }
 
-func handleFTPoverSSH(conn Connection) {
-	var fm ManagerFTPoverSSH = ManagerFTPoverSSH{}
+// downloadEntry transfers a single remote file, verifies its size and records
+// it in the database. dir is the listing of the file's folder. Failures are
+// logged and do not stop the traversal; the result reports whether the file
+// is done, i.e. skipped, downloaded now or earlier.
+func downloadEntry(file RemoteEntry, remoteFilePath, localFilePath string, dir []RemoteEntry, fm Manager, conn Connection) bool {
+	if isChecksumSidecar(conn, file.Name) || isMarker(conn, file.Name) {
+		return true
+	}
+	// Another worker may be transferring a file with the same name and size
+	key := transferKey(conn.Name, file.Name, file.Size)
+	if !claimTransfer(key) {
+		logger.Debugf("File already being downloaded: %s\n", file.Name)
+		return false
+	}
+	defer releaseTransfer(key)
+
+	// Check if the file has already been downloaded
+	db.mu.Lock()
+	existingFiles, err := searchDownloadedFileEntries(db.conn, file.Name, file.Size, conn.Name)
+	db.mu.Unlock()
 
-	// Attempt to connect to the FTPoverSSH server
-	err := fm.connect(conn)
 	if err != nil {
-		logger.Debugf("Error connecting to FTPoverSSH: %v\n", err)
-		return
+		logger.Debugf("Error searching for existing file entries: %v\n", err)
+		return false
 	}
 
-	// Define the source folder for downloads
-	var srcFolder string = conn.Path
-	// Define the local directory for downloads
-	localDir := download_folder
-	if conn.Separate {
-		localDir = path.Join(download_folder, conn.Name)
-	}
-	if _, err := os.Stat(localDir); os.IsNotExist(err) {
-		// Create the local directory if it does not exist
-		err := os.MkdirAll(localDir, os.ModePerm)
-		if err != nil {
-			logger.Debugf("Error creating directory: %v\n", err)
-			return
+	if len(existingFiles) > 0 {
+		logger.Warnf("File already downloaded: %s\n", file.Name)
+		// Retry a marker that could not be handled after the download
+		if conn.Marker != "" && markerPendingFor(conn, file) {
+			finishFileMarker(fm, conn, file, remoteFilePath, localFilePath, dir)
 		}
+		return true
 	}
 
-	// Start downloading files from the source folder to the local directory
-	// implement this
-	err = recursivelyDownloadFTP(srcFolder, localDir, conn.Depth, &fm, conn) // Adjust the depth as needed
-	if err != nil {
-		logger.Debugf("Error downloading files: %v\n", err)
+	// Files already downloaded count as done even when their marker is gone
+	if !markerReleased(conn, file, dir) {
+		return false
 	}
 
-	// Close connections
-	fm.ftpConn.Quit()
-	fm.sshConn.Close()
-}
-
-func handleFTP(conn Connection) {
-	var fm ManagerFTP = ManagerFTP{}
+	if !fileIsStable(conn, file, remoteFilePath, time.Now()) {
+		return false
+	}
 
-	// Attempt to connect to the FTP server
-	err := fm.connect(conn)
+	sum, err := resumableDownload(fm, conn, file, remoteFilePath, localFilePath)
 	if err != nil {
-		logger.Debugf("Error connecting to FTP: %v\n", err)
-		return
+		logger.Debugf("Error downloading file: %v\n", err)
+		return false
 	}
 
-	// Define the source folder for downloads
-	var srcFolder string = conn.Path
-
-	// Define the local directory for downloads
-	localDir := download_folder
-	if conn.Separate {
-		localDir = path.Join(download_folder, conn.Name)
+	// Verify the file size to ensure the download was successful
+	localFileInfo, err := os.Stat(localFilePath)
+	if err != nil {
+		logger.Debugf("Error stating local file: %v\n", err)
+		return false
 	}
-	if _, err := os.Stat(localDir); os.IsNotExist(err) {
-		// Create the local directory if it does not exist
-		err := os.MkdirAll(localDir, os.ModePerm)
+
+	if localFileInfo.Size() != file.Size {
+		logger.Debugf("File size mismatch for %s: expected %d, got %d\n", file.Name, file.Size, localFileInfo.Size())
+		// If the file sizes do not match, delete the local file
+		err = os.Remove(localFilePath)
 		if err != nil {
-			logger.Debugf("Error creating directory: %v\n", err)
-			return
+			logger.Debugf("Error deleting invalid local file: %v\n", err)
+		} else {
+			logger.Debugf("Deleted invalid local file: %s\n", localFilePath)
 		}
+		return false
 	}
 
-	// Start downloading files from the source folder to the local directory
-	err = recursivelyDownloadFTP(srcFolder, localDir, conn.Depth, &fm, conn) // Adjust the depth as needed
+	logger.Debugf("File size match for %s: %d bytes\n", file.Name, file.Size)
+
+	// If the file sizes match, apply the post action on the server. A file
+	// whose checksum could not be verified is left in place.
+	action, actionPath := applyVerifiedPostAction(fm, conn, remoteFilePath, sum, time.Now())
+	finishSidecar(fm, conn, file, remoteFilePath, dir, sum)
+
+	// Create a downloaded file entry
+	downloadedFile := DownloadedFile{
+		FileName:       file.Name,
+		ServerName:     conn.Name,
+		FileSize:       localFileInfo.Size(),
+		DownloadTime:   time.Now().Format("2006-01-02 15:04:05"),
+		Checksum:       sum.String(),
+		PostAction:     action,
+		PostActionPath: actionPath,
+		Marker:         markerState(conn),
+	}
+
+	// Save the downloaded file entry to the database
+	db.mu.Lock()
+	err = saveDownloadedFileEntry(db.conn, downloadedFile)
+	db.mu.Unlock()
 	if err != nil {
-		logger.Debugf("Error downloading files: %v\n", err)
+		logger.Fatalf("Failed to save file entry: %v", err)
 	}
+	forgetPendingFile(conn, remoteFilePath)
 
-	fm.ftpConn.Quit()
+	if conn.Marker != "" {
+		finishFileMarker(fm, conn, file, remoteFilePath, localFilePath, dir)
+	}
+	return true
 }
 
-func handleSFTP(conn Connection) {
-	var fm ManagerSFTP = ManagerSFTP{}
+// connectManager connects fm and records host key verification failures
+// against the connection so they are visible through the /errors endpoint.
+func connectManager(fm Manager, conn Connection) error {
+	err := fm.connect(conn)
 
-	// Attempt to connect to the SFTP server
-	err := fm.connectToSFTP(conn)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if errors.Is(err, errHostKeyMismatch) {
+		logger.Errorf("Host key verification failed for %s: %v\n", conn.Name, err)
+		if err := saveConnectionError(db.conn, conn.Name, err.Error()); err != nil {
+			logger.Errorf("Failed to save connection error: %v\n", err)
+		}
+	} else if err == nil {
+		if err := clearConnectionError(db.conn, conn.Name); err != nil {
+			logger.Debugf("Failed to clear connection error: %v\n", err)
+		}
+	}
+	return err
+}
+
+// handleDownload connects fm using conn, mirrors conn.Path into the local
+// download directory and closes the connection when done.
+func handleDownload(conn Connection, fm Manager) {
+	// Attempt to connect to the server
+	err := connectManager(fm, conn)
 	if err != nil {
-		logger.Debugf("Error connecting to SFTP: %v\n", err)
+		logger.Debugf("Error connecting to %s: %v\n", conn.Protocol, err)
 		return
 	}
+	defer fm.close()
 
 	// Define the source folder for downloads
 	var srcFolder string = conn.Path
@@ -641,14 +830,10 @@ func handleSFTP(conn Connection) {
 	}
 
 	// Start downloading files from the source folder to the local directory
-	err = recursivelyDownloadSFTP(srcFolder, localDir, conn.Depth, fm, conn)
+	err = recursivelyDownload(srcFolder, localDir, conn.Depth, fm, conn)
 	if err != nil {
 		logger.Debugf("Error downloading files: %v\n", err)
 	}
-
-	// Ensure the SFTP client and SSH connection are closed when done
-	fm.sftpClient.Close()
-	fm.sshConn.Close()
 }
 
 func handleConnection(conns []Connection, split string) {
@@ -656,13 +841,12 @@ func handleConnection(conns []Connection, split string) {
 		for i, conn := range conns {
 			logger.Debugf("=== Connection: %d of %d, Split: %s, Name: %s, Host: %s, Port: %d, Protocol: %s, Username: %s\n", i+1, len(conns), split, conn.Name, conn.Host, conn.Port, conn.Protocol, conn.Username)
 
-			switch conn.Protocol {
-			case "sftp":
-				handleSFTP(conn)
-			case "ftp":
-				handleFTP(conn)
-			case "ftpoverssh":
-				handleFTPoverSSH(conn)
+			if backend, ok := lookupBackend(conn.Protocol); !ok {
+				logger.Errorf("Unsupported protocol for %s: %s\n", conn.Name, conn.Protocol)
+			} else if conn.Direction == directionUpload {
+				handleUpload(conn, backend.New())
+			} else {
+				handleDownload(conn, backend.New())
 			}
 
 			time.Sleep(time.Duration(conn.Delay) * time.Second)
@@ -672,91 +856,115 @@ func handleConnection(conns []Connection, split string) {
 }
 
 func (fm *ManagerFTPoverSSH) connect(conn Connection) error {
-	var config *ssh.ClientConfig
-
 	// SFTP connection logic
 	logger.Debugf("Connecting to SFTP: Host: %s, Port: %d, Username: %s\n", conn.Host, conn.Port, conn.Username)
-	// Check if the connection contains an SSH key
-	if conn.SSHKeyPath != "" {
-		logger.Infof("Using SSH key for authentication: %s\n", conn.SSHKeyPath)
-		key, err := os.ReadFile(conn.SSHKeyPath)
-		if err != nil {
-			return fmt.Errorf("failed to read SSH key file: %v", err)
-		}
-
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
-			return fmt.Errorf("failed to parse SSH key: %v", err)
-		}
-
-		config = &ssh.ClientConfig{
-			User: conn.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         5 * time.Second, // Add timeout of 5 seconds
-		}
-
-	} else {
-		logger.Debugf("Using password for authentication: %s\n", conn.Username)
-		// Set up SSH client configuration
-		config = &ssh.ClientConfig{
-			User: conn.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(conn.Password),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         5 * time.Second, // Add timeout of 5 seconds
-		}
-	}
 
 	// Connect to the SSH server
-	addr := fmt.Sprintf("%s:%d", conn.Host, conn.Port)
-	sshConn, err := ssh.Dial("tcp", addr, config)
+	sshConn, err := dialSSH(conn)
 	if err != nil {
-		return fmt.Errorf("failed to dial SSH: %v", err)
+		return err
 	}
 	fm.sshConn = sshConn
 
 	logger.Infof("Successfully connected to SSH: %s\n", conn.Name)
 
-	// TODO: change default port for ftp connection into ssh tunnel
-	// Create an FTP client over the SSH connection
-	ftpConn, err := ftp.Dial("127.0.0.1:21", ftp.DialWithDialFunc(func(network, addr string) (net.Conn, error) {
+	// Create an FTP client over the SSH connection. Passive data connections
+	// are forwarded through the same SSH client to the FTP host.
+	ftpHost, ftpPort, ftpUsername, ftpPassword := ftpOverSSHTarget(conn)
+	tunnel := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		logger.Debugf("Dialing FTP over SSH: network=%s, addr=%s\n", network, addr)
-		conn, err := fm.sshConn.Dial(network, addr)
+		conn, err := fm.sshConn.DialContext(ctx, network, addr)
 		if err != nil {
 			logger.Errorf("Failed to dial FTP over SSH: %v\n", err)
 		}
 		return conn, err
-	}))
+	}
+	ftpConn, err := ftp.Dial(hostPort(ftpHost, ftpPort), ftp.DialWithDialFunc(ftpDialFunc(tunnel, ftpHost, nil, false)))
 	if err != nil {
+		sshConn.Close()
 		return fmt.Errorf("failed to dial FTP over SSH: %v", err)
 	}
 
 	// Login to the FTP server
-	err = ftpConn.Login(conn.Username, conn.Password)
+	err = ftpConn.Login(ftpUsername, ftpPassword)
 	if err != nil {
 		ftpConn.Quit()
+		sshConn.Close()
 		return fmt.Errorf("failed to login to FTP: %v", err)
 	}
+	fm.openCommand = func() (*ftpCommandConn, error) {
+		control := ftpDialFunc(tunnel, ftpHost, nil, false)
+		return dialFTPCommand(control, hostPort(ftpHost, ftpPort), nil, false, ftpUsername, ftpPassword)
+	}
 
 	fm.ftpConn = ftpConn
 	logger.Debugf("Connected to FTP over SSH: %s\n", conn.Name)
 	return nil
 }
 
+// ftpOverSSHTarget returns the FTP server reached through the SSH tunnel and
+// its credentials. They default to 127.0.0.1:21 and the SSH credentials.
+func ftpOverSSHTarget(conn Connection) (string, int, string, string) {
+	host, port := conn.FTPHost, conn.FTPPort
+	username, password := conn.FTPUsername, conn.FTPPassword
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if port == 0 {
+		port = 21
+	}
+	if username == "" {
+		username = conn.Username
+	}
+	if password == "" {
+		password = conn.Password
+	}
+	return host, port, username, password
+}
+
+func (fm *ManagerFTPoverSSH) close() error {
+	err := fm.ManagerFTP.close()
+	if fm.sshConn != nil {
+		fm.sshConn.Close()
+	}
+	return err
+}
+
 func (fm *ManagerFTP) connect(conn Connection) error {
 	// FTP connection logic
 	logger.Debugf("Connecting to FTP: Host: %s, Port: %d, Username: %s\n", conn.Host, conn.Port, conn.Username)
 
 	// Set up FTP client configuration
-	addr := fmt.Sprintf("%s:%d", conn.Host, conn.Port)
-	ftpConn, err := ftp.Dial(addr, ftp.DialWithTimeout(5*time.Second))
+	addr := hostPort(conn.Host, conn.Port)
+	options := []ftp.DialOption{ftp.DialWithTimeout(5 * time.Second)}
+	var tlsConfig *tls.Config
+	if fm.tlsMode != ftpTLSNone {
+		var err error
+		tlsConfig, err = buildTLSConfig(conn)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %v", err)
+		}
+		if fm.tlsMode == ftpTLSImplicit {
+			options = append(options, ftp.DialWithTLS(tlsConfig))
+		} else {
+			options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+		}
+	}
+	dial, err := connectionDialer(conn)
+	if err != nil {
+		return err
+	}
+	if conn.Proxy != "" && conn.Proxy != proxyDirect {
+		options = append(options, ftp.DialWithDialFunc(ftpDialFunc(dial, conn.Host, tlsConfig, fm.tlsMode == ftpTLSImplicit)))
+	}
+	ftpConn, err := ftp.Dial(addr, options...)
 	if err != nil {
 		return fmt.Errorf("failed to dial FTP: %v", err)
 	}
+	fm.openCommand = func() (*ftpCommandConn, error) {
+		control := ftpDialFunc(dial, conn.Host, tlsConfig, fm.tlsMode == ftpTLSImplicit)
+		return dialFTPCommand(control, addr, tlsConfig, fm.tlsMode == ftpTLSExplicit, conn.Username, conn.Password)
+	}
 
 	//welcomeMessage, err := ftp.StatusText()
 
@@ -772,45 +980,43 @@ func (fm *ManagerFTP) connect(conn Connection) error {
 	return nil
 }
 
-func (fm *ManagerFTP) readDir(remotePath string) ([]*ftp.Entry, error) {
+func (fm *ManagerFTP) readDir(remotePath string) ([]RemoteEntry, error) {
 	// Read the directory contents from the remote FTP server
 	entries, err := fm.ftpConn.List(remotePath)
 	if err != nil {
 		return nil, fmt.Errorf("error reading directory: %v", err)
 	}
-	var fileStats []*ftp.Entry
+	var fileStats []RemoteEntry
 	for _, entry := range entries {
-		if entry.Type == ftp.EntryTypeFile {
-			fileStats = append(fileStats, entry)
-			logger.Debugf("File: %s, Size: %d, Modified: %s\n", entry.Name, entry.Size, entry.Time)
+		if entry.Name == "." || entry.Name == ".." {
+			continue
 		}
+		fileStats = append(fileStats, entryFromFTP(entry))
+		logger.Debugf("%s: %s, Size: %d, Modified: %s\n", entry.Type, entry.Name, entry.Size, entry.Time)
 	}
 	return fileStats, nil
 }
 
-func (fm *ManagerFTP) downloadFile(remotePath, localPath string) error {
-	// Open the remote file
-	resp, err := fm.ftpConn.Retr(remotePath)
-	if err != nil {
-		return fmt.Errorf("error opening remote file: %v", err)
-	}
-	defer resp.Close()
-
-	// Create the local file
-	localFile, err := os.Create(localPath)
+func (fm *ManagerFTP) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	// Open the remote file, sending REST first when resuming
+	resp, err := fm.ftpConn.RetrFrom(remotePath, uint64(offset))
 	if err != nil {
-		return fmt.Errorf("error creating local file: %v", err)
+		if offset > 0 && restRefused(err) {
+			return nil, errResumeNotSupported
+		}
+		return nil, fmt.Errorf("error opening remote file: %v", err)
 	}
-	defer localFile.Close()
+	return resp, nil
+}
 
-	// Copy the file contents from the remote file to the local file
-	_, err = io.Copy(localFile, resp)
-	if err != nil {
-		return fmt.Errorf("error copying file: %v", err)
+// restRefused reports whether err is the reply of a server that does not
+// implement REST. Failures of RETR itself use 4xx or 550 replies.
+func restRefused(err error) bool {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) {
+		return false
 	}
-
-	logger.Infof("Downloaded file: %s\n", remotePath)
-	return nil
+	return reply.Code >= ftp.StatusBadCommand && reply.Code <= ftp.StatusNotImplementedParameter
 }
 
 func (fm *ManagerFTP) deleteFile(remotePath string) error {
@@ -823,111 +1029,151 @@ func (fm *ManagerFTP) deleteFile(remotePath string) error {
 	return nil
 }
 
-func (fm *ManagerFTPoverSSH) readDir(remotePath string) ([]*ftp.Entry, error) {
-	// Read the directory contents from the remote FTP server
-	entries, err := fm.ftpConn.List(remotePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading directory: %v", err)
+func (fm *ManagerFTP) rename(oldPath, newPath string) error {
+	if err := fm.ftpConn.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("error renaming file on FTP server: %v", err)
 	}
-	var fileStats []*ftp.Entry
-	for _, entry := range entries {
-
-		if entry.Type == ftp.EntryTypeFile {
-			fileStats = append(fileStats, entry)
-			logger.Debugf("File: %s, Size: %d, Modified: %s\n", entry.Name, entry.Size, entry.Time)
-		} else if entry.Type == ftp.EntryTypeFolder {
-			fileStats = append(fileStats, entry)
-			logger.Debugf("Folder: %s, Size: %d, Modified: %s\n", entry.Name, entry.Size, entry.Time)
-		} else {
-			logger.Debugf("Other filetype: %s, Size: %d, Modified: %s\n", entry.Name, entry.Size, entry.Time)
+	return nil
+}
 
+func (fm *ManagerFTP) makeDir(remotePath string) error {
+	// FTP has no recursive MKD, so create every missing parent in turn. A
+	// 550 reply is only ignored for folders that already exist.
+	current := ""
+	if path.IsAbs(remotePath) {
+		current = "/"
+	}
+	for _, part := range strings.Split(path.Clean(remotePath), "/") {
+		if part == "" || part == "." {
+			continue
 		}
-
+		current = path.Join(current, part)
+		err := fm.ftpConn.MakeDir(current)
+		if err == nil {
+			continue
+		}
+		var reply *textproto.Error
+		if errors.As(err, &reply) && reply.Code == ftp.StatusFileUnavailable && fm.isDir(current) {
+			continue
+		}
+		return fmt.Errorf("error creating remote directory %s: %v", current, err)
 	}
-	return fileStats, nil
+	return nil
 }
 
-func (fm *ManagerFTPoverSSH) downloadFile(remotePath, localPath string) error {
-	// Open the remote file
-	resp, err := fm.ftpConn.Retr(remotePath)
+// isDir reports whether remotePath is a folder by changing into it and back.
+func (fm *ManagerFTP) isDir(remotePath string) bool {
+	cwd, err := fm.ftpConn.CurrentDir()
 	if err != nil {
-		return fmt.Errorf("error opening remote file: %v", err)
+		return false
 	}
-	defer resp.Close()
-
-	// Create the local file
-	localFile, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("error creating local file: %v", err)
+	if err := fm.ftpConn.ChangeDir(remotePath); err != nil {
+		return false
 	}
-	defer localFile.Close()
-
-	// Copy the file contents from the remote file to the local file
-	_, err = io.Copy(localFile, resp)
-	if err != nil {
-		return fmt.Errorf("error copying file: %v", err)
+	if err := fm.ftpConn.ChangeDir(cwd); err != nil {
+		logger.Debugf("Error returning to FTP directory %s: %v\n", cwd, err)
 	}
+	return true
+}
 
-	logger.Infof("Downloaded file: %s\n", remotePath)
+func (fm *ManagerFTP) writeFile(remotePath string, r io.Reader) error {
+	if err := fm.ftpConn.Stor(remotePath, r); err != nil {
+		return fmt.Errorf("error storing remote file: %v", err)
+	}
 	return nil
 }
 
-func (fm *ManagerFTPoverSSH) deleteFile(remotePath string) error {
-	// Delete the file from the FTP server
-	err := fm.ftpConn.Delete(remotePath)
+func (fm *ManagerFTP) stat(remotePath string) (RemoteEntry, error) {
+	size, err := fm.ftpConn.FileSize(remotePath)
 	if err != nil {
-		return fmt.Errorf("error deleting file from FTP server: %v", err)
+		return RemoteEntry{}, err
 	}
-	logger.Debugf("Deleted file from FTP server: %s\n", remotePath)
-	return nil
+	return RemoteEntry{Name: path.Base(remotePath), Size: size, Kind: EntryFile}, nil
 }
 
-func (fm *ManagerSFTP) connectToSFTP(conn Connection) error {
-
-	var config *ssh.ClientConfig
-
-	// SFTP connection logic
-	logger.Debugf("Connecting to SFTP: Host: %s, Port: %d, Username: %s\n", conn.Host, conn.Port, conn.Username)
-	// Check if the connection contains an SSH key
-	if conn.SSHKeyPath != "" {
-		logger.Infof("Using SSH key for authentication: %s\n", conn.SSHKeyPath)
-		key, err := os.ReadFile(conn.SSHKeyPath)
-		if err != nil {
-			return fmt.Errorf("failed to read SSH key file: %v", err)
+// remoteChecksum asks the server for a checksum with the HASH extension,
+// falling back to the older XSHA256/XMD5/XCRC commands.
+func (fm *ManagerFTP) remoteChecksum(remotePath, algorithm string) (string, error) {
+	alg := checksumAlgorithms[algorithm]
+	if fm.cmdConn == nil {
+		if fm.openCommand == nil {
+			return "", errors.New("not connected")
 		}
-
-		signer, err := ssh.ParsePrivateKey(key)
+		c, err := fm.openCommand()
 		if err != nil {
-			return fmt.Errorf("failed to parse SSH key: %v", err)
+			return "", fmt.Errorf("error opening command connection: %v", err)
 		}
+		fm.cmdConn = c
+	}
 
-		config = &ssh.ClientConfig{
-			User: conn.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         5 * time.Second, // Add timeout of 5 seconds
+	// The HASH extension selects the algorithm first, then hashes the file
+	_, _, err := fm.cmdConn.cmd(ftp.StatusCommandOK, "OPTS HASH %s", alg.hashName)
+	if err == nil {
+		var msg string
+		_, msg, err = fm.cmdConn.cmd(ftp.StatusFile, "HASH %s", remotePath)
+		if sum := findChecksum(msg, alg.hexLen); err == nil && sum != "" {
+			return sum, nil
 		}
+	}
+	var reply *textproto.Error
+	if err != nil && !errors.As(err, &reply) {
+		// The command connection itself failed
+		fm.cmdConn.close()
+		fm.cmdConn = nil
+		return "", err
+	}
 
-	} else {
-		logger.Debugf("Using password for authentication: %s\n", conn.Username)
-		// Set up SSH client configuration
-		config = &ssh.ClientConfig{
-			User: conn.Username,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(conn.Password),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         5 * time.Second, // Add timeout of 5 seconds
-		}
+	_, msg, err := fm.cmdConn.cmd(2, "%s %s", alg.ftpCommand, remotePath)
+	if err != nil {
+		return "", fmt.Errorf("server does not support HASH or %s: %v", alg.ftpCommand, err)
+	}
+	if sum := findChecksum(msg, alg.hexLen); sum != "" {
+		return sum, nil
+	}
+	return "", fmt.Errorf("unexpected %s reply: %s", alg.ftpCommand, msg)
+}
+
+func (fm *ManagerFTP) close() error {
+	if fm.cmdConn != nil {
+		fm.cmdConn.close()
+		fm.cmdConn = nil
+	}
+	if fm.ftpConn == nil {
+		return nil
 	}
+	return fm.ftpConn.Quit()
+}
+
+func entryFromFTP(entry *ftp.Entry) RemoteEntry {
+	re := RemoteEntry{
+		Name:    entry.Name,
+		Size:    int64(entry.Size),
+		ModTime: entry.Time,
+	}
+	switch entry.Type {
+	case ftp.EntryTypeFile:
+		re.Kind = EntryFile
+	case ftp.EntryTypeFolder:
+		re.Kind = EntryFolder
+		re.Mode = os.ModeDir
+	case ftp.EntryTypeLink:
+		re.Kind = EntryLink
+		re.Mode = os.ModeSymlink
+	default:
+		re.Kind = EntryOther
+	}
+	return re
+}
+
+func (fm *ManagerSFTP) connect(conn Connection) error {
+
+	// SFTP connection logic
+	logger.Debugf("Connecting to SFTP: Host: %s, Port: %d, Username: %s\n", conn.Host, conn.Port, conn.Username)
 
 	// Connect to the SSH server
-	addr := fmt.Sprintf("%s:%d", conn.Host, conn.Port)
-	sshConn, err := ssh.Dial("tcp", addr, config)
+	sshConn, err := dialSSH(conn)
 	if err != nil {
-		return fmt.Errorf("failed to dial SSH: %v", err)
+		return err
 	}
 	fm.sshConn = sshConn
 	// Create an SFTP client
@@ -943,6 +1189,143 @@ func (fm *ManagerSFTP) connectToSFTP(conn Connection) error {
 	return nil
 }
 
+func (fm *ManagerSFTP) readDir(remotePath string) ([]RemoteEntry, error) {
+	// Read the directory contents from the remote SFTP server
+	files, err := fm.sftpClient.ReadDir(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %v", err)
+	}
+	entries := make([]RemoteEntry, 0, len(files))
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink != 0 {
+			// Follow symbolic links so linked files and folders are transferred
+			if target, err := fm.sftpClient.Stat(path.Join(remotePath, file.Name())); err == nil {
+				entry := entryFromFileInfo(target)
+				entry.Name = file.Name()
+				entries = append(entries, entry)
+				continue
+			}
+		}
+		entries = append(entries, entryFromFileInfo(file))
+	}
+	return entries, nil
+}
+
+func (fm *ManagerSFTP) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	srcFile, err := fm.sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seek to the start position in the source file
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		srcFile.Close()
+		return nil, fmt.Errorf("error seeking in source file: %v", err)
+	}
+	return srcFile, nil
+}
+
+func (fm *ManagerSFTP) deleteFile(remotePath string) error {
+	return fm.sftpClient.Remove(remotePath)
+}
+
+func (fm *ManagerSFTP) rename(oldPath, newPath string) error {
+	return fm.sftpClient.Rename(oldPath, newPath)
+}
+
+func (fm *ManagerSFTP) makeDir(remotePath string) error {
+	return fm.sftpClient.MkdirAll(remotePath)
+}
+
+func (fm *ManagerSFTP) writeFile(remotePath string, r io.Reader) error {
+	dstFile, err := fm.sftpClient.Create(remotePath)
+	if err != nil {
+		return fmt.Errorf("error creating remote file: %v", err)
+	}
+	if _, err := dstFile.ReadFrom(r); err != nil {
+		dstFile.Close()
+		return fmt.Errorf("error copying file: %v", err)
+	}
+	return dstFile.Close()
+}
+
+func (fm *ManagerSFTP) stat(remotePath string) (RemoteEntry, error) {
+	info, err := fm.sftpClient.Stat(remotePath)
+	if err != nil {
+		return RemoteEntry{}, err
+	}
+	return entryFromFileInfo(info), nil
+}
+
+// remoteChecksum runs sha256sum or md5sum on the server over SSH.
+func (fm *ManagerSFTP) remoteChecksum(remotePath, algorithm string) (string, error) {
+	alg := checksumAlgorithms[algorithm]
+	if alg.sumCommand == "" {
+		return "", fmt.Errorf("no command for %s checksums over SSH", algorithm)
+	}
+	session, err := fm.sshConn.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("error opening SSH session: %v", err)
+	}
+	defer session.Close()
+
+	out, err := session.Output(alg.sumCommand + " " + shellQuote(remotePath))
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", alg.sumCommand, err)
+	}
+	sum := findChecksum(string(out), alg.hexLen)
+	if sum == "" {
+		return "", fmt.Errorf("unexpected %s output: %q", alg.sumCommand, out)
+	}
+	return sum, nil
+}
+
+// openFileAt opens the remote file for concurrent reads at any offset.
+func (fm *ManagerSFTP) openFileAt(remotePath string) (remoteFileAt, error) {
+	f, err := fm.sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening remote file: %v", err)
+	}
+	return f, nil
+}
+
+// The SFTP client pipelines requests, so workers can share one connection.
+func (fm *ManagerSFTP) concurrentSafe() {}
+
+func (fm *ManagerSFTP) close() error {
+	// Ensure the SFTP client and SSH connection are closed when done
+	if fm.sftpClient != nil {
+		fm.sftpClient.Close()
+	}
+	if fm.sshConn != nil {
+		return fm.sshConn.Close()
+	}
+	return nil
+}
+
+// entryFromFileInfo converts the os.FileInfo returned by SFTP, WebDAV and
+// local listings into a RemoteEntry.
+func entryFromFileInfo(info os.FileInfo) RemoteEntry {
+	re := RemoteEntry{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+	switch {
+	case info.Mode().IsRegular():
+		re.Kind = EntryFile
+	case info.IsDir():
+		re.Kind = EntryFolder
+	case info.Mode()&os.ModeSymlink != 0:
+		re.Kind = EntryLink
+	default:
+		re.Kind = EntryOther
+	}
+	return re
+}
+
 func recreateFolder(folderPath string) error {
 	// Delete the folder and its contents
 	err := os.RemoveAll(folderPath)
@@ -960,10 +1343,14 @@ func recreateFolder(folderPath string) error {
 	return nil
 }
 
-func checkHostPort(host string, port int) bool {
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func checkHostPort(probe Connection) bool {
 	timeout := 2 * time.Second
-	address := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", address, timeout)
+	address := hostPort(probe.Host, probe.Port)
+	conn, err := dialConnection(probe, address, timeout)
 	if err != nil {
 		return false
 	}
@@ -1054,6 +1441,10 @@ func main() {
 		logger.Fatalf("Error: %v\n", err)
 		return
 	}
+	if err := setGlobalRateLimit(config); err != nil {
+		logger.Fatalf("Error: %v\n", err)
+		return
+	}
 
 	if *keygen {
 
@@ -1089,7 +1480,19 @@ func main() {
 
 	go handleHTTP(*port)
 
-	Connections = splitConnections(config, *threads)
+	// Connections used by routes are driven by their routes only
+	routeConns := make(map[string]Connection)
+	members := routeConnectionNames(config)
+	standalone := Config{}
+	for _, conn := range config.Connections {
+		if members[conn.Name] {
+			routeConns[conn.Name] = conn
+		} else {
+			standalone.Connections = append(standalone.Connections, conn)
+		}
+	}
+
+	Connections = splitConnections(standalone, *threads)
 
 	logger.Debug("Splitted Connections Table:")
 	logger.Infof("-------------------------------------------------------------------------")
@@ -1105,18 +1508,34 @@ func main() {
 	for split, conns := range Connections.Connection {
 		logger.Infof("=== %s - %d ===\n", split, len(conns))
 		for i := range conns {
-			if checkHostPort(conns[i].Host, conns[i].Port) {
+			if conns[i].Host == "" {
+				// Backends such as s3 and local have no host to probe
 				conns[i].Status = true
-				logger.Infof("Connection to %s:%d is available\n", conns[i].Host, conns[i].Port)
+				continue
+			}
+			// Behind a bastion only the first jump host is reachable from here
+			probe := conns[i]
+			if hops := jumpHosts(conns[i]); len(hops) > 0 {
+				probe = hops[0]
+			}
+			host, port := probe.Host, probe.Port
+			if checkHostPort(probe) {
+				conns[i].Status = true
+				logger.Infof("Connection to %s:%d is available\n", host, port)
 			} else {
 				conns[i].Status = false
-				logger.Errorf("Connection to %s:%d is not available\n", conns[i].Host, conns[i].Port)
+				logger.Errorf("Connection to %s:%d is not available\n", host, port)
 			}
 		}
 
 		go handleConnection(conns, split)
 	}
 
+	for _, route := range config.Routes {
+		logger.Infof("=== route %s: %s -> %v ===\n", route.Name, route.Source, route.Destinations)
+		go handleRoute(route, routeConns)
+	}
+
 	// Block main goroutine until an interrupt signal is received
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
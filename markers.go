@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What happens to a marker file once the data it releases was downloaded.
+const (
+	markerKeep     = "keep"
+	markerDownload = "download"
+	markerDelete   = "delete"
+
+	// markerPending is stored for downloaded files whose marker action
+	// has not been applied yet.
+	markerPending = "pending"
+)
+
+func validateMarkers(conn Connection) error {
+	switch conn.MarkerAction {
+	case "", markerKeep, markerDownload, markerDelete:
+	default:
+		return fmt.Errorf("invalid marker_action for %s: %s", conn.Name, conn.MarkerAction)
+	}
+	if conn.MarkerAction != "" && conn.Marker == "" && conn.BatchMarker == "" {
+		return fmt.Errorf("marker_action for %s requires marker or batch_marker", conn.Name)
+	}
+	if strings.Contains(conn.Marker, "/") || strings.Contains(conn.BatchMarker, "/") {
+		return fmt.Errorf("markers for %s must be file names without a path", conn.Name)
+	}
+	if (conn.Marker != "" || conn.BatchMarker != "") && conn.Direction == directionUpload {
+		return fmt.Errorf("markers are not supported for uploads: %s", conn.Name)
+	}
+	return nil
+}
+
+// isMarker reports whether name is a marker file of conn. Markers release
+// data files and are never picked up as data themselves.
+func isMarker(conn Connection, name string) bool {
+	if conn.BatchMarker != "" && name == conn.BatchMarker {
+		return true
+	}
+	return conn.Marker != "" && len(name) > len(conn.Marker) && strings.HasSuffix(name, conn.Marker)
+}
+
+// markerReleased reports whether the markers file depends on are present in
+// dir, the listing of its folder.
+func markerReleased(conn Connection, file RemoteEntry, dir []RemoteEntry) bool {
+	if conn.BatchMarker != "" {
+		if _, ok := findEntry(dir, conn.BatchMarker); !ok {
+			logger.Debugf("Batch marker %s missing, skipping: %s\n", conn.BatchMarker, file.Name)
+			return false
+		}
+	}
+	if conn.Marker != "" {
+		if _, ok := findEntry(dir, file.Name+conn.Marker); !ok {
+			logger.Debugf("Marker %s%s missing, skipping: %s\n", file.Name, conn.Marker, file.Name)
+			return false
+		}
+	}
+	return true
+}
+
+func findEntry(dir []RemoteEntry, name string) (RemoteEntry, bool) {
+	for _, entry := range dir {
+		if entry.Kind == EntryFile && entry.Name == name {
+			return entry, true
+		}
+	}
+	return RemoteEntry{}, false
+}
+
+// markerState is the marker column saved for a file downloaded for conn.
+// Markers that stay on the server untouched need no tracking.
+func markerState(conn Connection) string {
+	if conn.Marker == "" && conn.BatchMarker == "" {
+		return ""
+	}
+	switch conn.MarkerAction {
+	case markerDownload, markerDelete:
+		return markerPending
+	}
+	return ""
+}
+
+// markerPendingFor reports whether file was downloaded before but the action
+// of its marker still has to be applied.
+func markerPendingFor(conn Connection, file RemoteEntry) bool {
+	db.mu.Lock()
+	existing, err := searchDownloadedFileEntries(db.conn, file.Name, file.Size, conn.Name)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error searching for existing file entries: %v\n", err)
+		return false
+	}
+	for _, entry := range existing {
+		if entry.Marker == markerPending {
+			return true
+		}
+	}
+	return false
+}
+
+// finishMarker applies the marker action to a marker whose data was
+// downloaded and records it against the data files it released. Markers
+// are fetched after their data so local consumers that watch for them never
+// see incomplete data. A marker that could not be handled stays pending and
+// is retried on the next pass.
+func finishMarker(fm Manager, conn Connection, marker RemoteEntry, remoteMarkerPath, localMarkerPath string, data []RemoteEntry) {
+	switch conn.MarkerAction {
+	case markerDownload:
+		markerConn := conn
+		markerConn.Checksum = ""
+		markerConn.SegmentThreshold = 0
+		if _, err := resumableDownload(fm, markerConn, marker, remoteMarkerPath, localMarkerPath); err != nil {
+			logger.Errorf("Error downloading marker %s: %v\n", remoteMarkerPath, err)
+			return
+		}
+		logger.Debugf("Downloaded marker: %s\n", remoteMarkerPath)
+		applyPostAction(fm, conn, remoteMarkerPath, time.Now())
+	case markerDelete:
+		if err := fm.deleteFile(remoteMarkerPath); err != nil {
+			logger.Errorf("Error deleting marker from server: %v\n", err)
+			return
+		}
+		logger.Debugf("Deleted marker from server: %s\n", remoteMarkerPath)
+	default:
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, file := range data {
+		if err := saveMarkerDone(db.conn, file.Name, file.Size, conn.Name, conn.MarkerAction); err != nil {
+			logger.Errorf("Failed to save marker state: %v\n", err)
+		}
+	}
+}
+
+// finishFileMarker finishes the marker of file, if it is in dir.
+func finishFileMarker(fm Manager, conn Connection, file RemoteEntry, remoteFilePath, localFilePath string, dir []RemoteEntry) {
+	if marker, ok := findEntry(dir, file.Name+conn.Marker); ok {
+		finishMarker(fm, conn, marker, remoteFilePath+conn.Marker, localFilePath+conn.Marker, []RemoteEntry{file})
+	}
+}
+
+// markerBatches tracks the folders released by a batch marker during one
+// pass, keyed by remote folder. Their marker is finished once every released
+// file was downloaded.
+type markerBatches struct {
+	mu      sync.Mutex
+	batches map[string]*markerBatch
+}
+
+type markerBatch struct {
+	marker     RemoteEntry
+	remotePath string
+	localPath  string
+	files      []RemoteEntry
+	failed     bool
+}
+
+// add registers file and the batch marker of the folder holding it.
+func (b *markerBatches) add(conn Connection, dir []RemoteEntry, file RemoteEntry, remoteFilePath, localFilePath string) {
+	marker, ok := findEntry(dir, conn.BatchMarker)
+	if !ok {
+		return
+	}
+	folder := path.Dir(remoteFilePath)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batches == nil {
+		b.batches = make(map[string]*markerBatch)
+	}
+	if _, ok := b.batches[folder]; !ok {
+		b.batches[folder] = &markerBatch{
+			marker:     marker,
+			remotePath: path.Join(folder, marker.Name),
+			localPath:  path.Join(path.Dir(localFilePath), marker.Name),
+		}
+	}
+	b.batches[folder].files = append(b.batches[folder].files, file)
+}
+
+// done records the outcome of a file of the folder holding remoteFilePath.
+func (b *markerBatches) done(remoteFilePath string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if batch, found := b.batches[path.Dir(remoteFilePath)]; found && !ok {
+		batch.failed = true
+	}
+}
+
+// finish applies the marker action to every folder whose files all arrived,
+// unless it was already applied for all of them on an earlier pass.
+func (b *markerBatches) finish(fm Manager, conn Connection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, batch := range b.batches {
+		if batch.failed {
+			logger.Warnf("Batch incomplete, keeping marker: %s\n", batch.remotePath)
+			continue
+		}
+		for _, file := range batch.files {
+			if markerPendingFor(conn, file) {
+				finishMarker(fm, conn, batch.marker, batch.remotePath, batch.localPath, batch.files)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadWaitsForMarker(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/a.csv":      []byte("alpha"),
+		"/in/a.csv.done": nil,
+		"/in/b.csv":      []byte("bravo"),
+	}}
+	conn := Connection{Name: "markers", Path: "/in", Depth: 1, Marker: ".done", MarkerAction: markerDownload}
+
+	handleDownload(conn, fm)
+	if data, err := os.ReadFile(filepath.Join(download_folder, "a.csv")); err != nil || string(data) != "alpha" {
+		t.Errorf("Expected a.csv to be released by its marker: %q (err: %v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "a.csv.done")); err != nil {
+		t.Errorf("Expected the marker to be downloaded: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "b.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected b.csv to wait for its marker")
+	}
+
+	fm.files["/in/b.csv.done"] = nil
+	handleDownload(conn, fm)
+	if data, err := os.ReadFile(filepath.Join(download_folder, "b.csv")); err != nil || string(data) != "bravo" {
+		t.Errorf("Expected b.csv once its marker exists: %q (err: %v)", data, err)
+	}
+}
+
+func TestDownloadDeletesMarker(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/a.csv":     []byte("alpha"),
+		"/in/a.csv.ok":  nil,
+		"/in/orphan.ok": nil,
+	}}
+	conn := Connection{Name: "markers", Path: "/in", Depth: 1, Marker: ".ok", MarkerAction: markerDelete, Remove: true}
+
+	handleDownload(conn, fm)
+	if len(fm.files) != 1 {
+		t.Errorf("Expected the data file and its marker to be removed, left %v", fm.files)
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "a.csv.ok")); !os.IsNotExist(err) {
+		t.Errorf("Expected the marker not to be downloaded")
+	}
+}
+
+func TestDownloadBatchMarker(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/ready/a.csv":   []byte("alpha"),
+		"/in/ready/b.csv":   []byte("bravo"),
+		"/in/ready/_READY":  nil,
+		"/in/pending/c.csv": []byte("charlie"),
+	}}
+	conn := Connection{Name: "batches", Path: "/in", Depth: 2, BatchMarker: "_READY", MarkerAction: markerDelete}
+
+	handleDownload(conn, fm)
+	for _, name := range []string{"ready/a.csv", "ready/b.csv"} {
+		if _, err := os.Stat(filepath.Join(download_folder, name)); err != nil {
+			t.Errorf("Expected %s to be released by the batch marker: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "pending/c.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected a folder without batch marker to be held back")
+	}
+	if _, ok := fm.files["/in/ready/_READY"]; ok {
+		t.Errorf("Expected the batch marker to be deleted once the folder was downloaded")
+	}
+}
+
+func TestDownloadRecurringMarkers(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/a.csv":       []byte("alpha"),
+		"/in/a.csv.done":  nil,
+		"/in/b.csv":       []byte("bravo"),
+		"/in/b.csv.done":  nil,
+		"/in/day1/x.csv":  []byte("x-ray"),
+		"/in/day1/_READY": nil,
+		"/in/day2/y.csv":  []byte("yankee"),
+		"/in/day2/_READY": nil,
+	}}
+	conn := Connection{Name: "recurring", Path: "/in", Depth: 2, Marker: ".done", MarkerAction: markerDownload}
+	handleDownload(conn, fm)
+	for _, name := range []string{"a.csv.done", "b.csv.done"} {
+		if _, err := os.Stat(filepath.Join(download_folder, name)); err != nil {
+			t.Errorf("Expected every empty marker to be downloaded, %s: %v", name, err)
+		}
+	}
+
+	conn = Connection{Name: "recurring_batch", Path: "/in", Depth: 2, BatchMarker: "_READY", MarkerAction: markerDownload}
+	handleDownload(conn, fm)
+	for _, name := range []string{"day1/_READY", "day2/_READY"} {
+		if _, err := os.Stat(filepath.Join(download_folder, name)); err != nil {
+			t.Errorf("Expected every empty batch marker to be downloaded, %s: %v", name, err)
+		}
+	}
+
+	// Markers already handled are not fetched again
+	os.Remove(filepath.Join(download_folder, "day1", "_READY"))
+	handleDownload(conn, fm)
+	if _, err := os.Stat(filepath.Join(download_folder, "day1", "_READY")); !os.IsNotExist(err) {
+		t.Errorf("Expected the handled batch marker not to be downloaded again")
+	}
+}
+
+func TestDownloadRetriesPendingMarker(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &readOnlyManager{fakeManager{files: map[string][]byte{
+		"/in/a.csv":    []byte("alpha"),
+		"/in/a.csv.ok": nil,
+		"/in/b/c.csv":  []byte("charlie"),
+		"/in/b/_READY": nil,
+	}}}
+	for _, tc := range []struct {
+		conn   Connection
+		marker string
+	}{
+		{Connection{Name: "retry", Path: "/in", Depth: 1, Marker: ".ok", MarkerAction: markerDelete}, "/in/a.csv.ok"},
+		{Connection{Name: "retry_batch", Path: "/in/b", Depth: 1, BatchMarker: "_READY", MarkerAction: markerDelete}, "/in/b/_READY"},
+	} {
+		handleDownload(tc.conn, fm)
+		if _, ok := fm.files[tc.marker]; !ok {
+			t.Fatalf("Expected the delete of %s to fail", tc.marker)
+		}
+		handleDownload(tc.conn, &fm.fakeManager)
+		if _, ok := fm.files[tc.marker]; ok {
+			t.Errorf("Expected the pending marker %s to be deleted on the next pass", tc.marker)
+		}
+	}
+}
+
+func TestDeletedMarkerKeepsFileDone(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fakeManager{files: map[string][]byte{
+		"/in/a.csv":    []byte("alpha"),
+		"/in/a.csv.ok": nil,
+		"/in/b.csv":    []byte("bravo"),
+	}}
+	conn := Connection{Name: "incremental", Path: "/in", Depth: 1, Marker: ".ok", MarkerAction: markerDelete, NewerThanLastRun: true}
+
+	handleDownload(conn, fm)
+	if lastRun, _ := loadLastRun(db.conn, conn.Name); !lastRun.IsZero() {
+		t.Fatalf("Expected no run to be recorded while b.csv waits for its marker")
+	}
+
+	// a.csv lost its marker but was downloaded already
+	fm.files["/in/b.csv.ok"] = nil
+	handleDownload(conn, fm)
+	if lastRun, err := loadLastRun(db.conn, conn.Name); err != nil || lastRun.IsZero() {
+		t.Errorf("Expected the run to be recorded once every file was downloaded (err: %v)", err)
+	}
+}
+
+func TestValidateMarkers(t *testing.T) {
+	if err := validateMarkers(Connection{Name: "m", MarkerAction: markerDelete}); err == nil {
+		t.Errorf("Expected marker_action without a marker to be rejected")
+	}
+	if err := validateMarkers(Connection{Name: "m", Marker: ".done", MarkerAction: "move"}); err == nil {
+		t.Errorf("Expected an unknown marker_action to be rejected")
+	}
+	if err := validateMarkers(Connection{Name: "m", BatchMarker: "sub/_READY"}); err == nil {
+		t.Errorf("Expected a batch marker with a path to be rejected")
+	}
+	if err := validateMarkers(Connection{Name: "m", Marker: ".done", MarkerAction: markerDownload}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
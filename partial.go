@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Suffixes of an in-progress download and of its metadata sidecar.
+const (
+	partSuffix     = ".part"
+	partMetaSuffix = ".part.meta"
+)
+
+// Delivery modes controlling where a download is written before it appears
+// under its final name.
+const (
+	deliveryPart    = "part"    // <name>.part next to the final file
+	deliveryStaging = "staging" // a staging directory outside the watched tree
+	deliveryDirect  = "direct"  // the final file itself, visible while written
+)
+
+func validateDelivery(conn Connection) error {
+	switch conn.Delivery {
+	case "", deliveryPart, deliveryDirect:
+		if conn.StagingDir != "" {
+			return fmt.Errorf("staging_dir requires delivery staging for %s", conn.Name)
+		}
+	case deliveryStaging:
+	default:
+		return fmt.Errorf("invalid delivery for %s: %s", conn.Name, conn.Delivery)
+	}
+	return nil
+}
+
+// partPaths returns where the download of localFilePath is written and where
+// its metadata is kept. Staged files are named after a hash of the final path
+// so that an interrupted download is found again on the next pass.
+func partPaths(conn Connection, localFilePath string) (string, string) {
+	switch conn.Delivery {
+	case deliveryDirect:
+		return localFilePath, localFilePath + partMetaSuffix
+	case deliveryStaging:
+		dir := conn.StagingDir
+		if dir == "" {
+			dir = defaultStagingDir()
+		}
+		sum := sha1.Sum([]byte(localFilePath))
+		name := fmt.Sprintf("%x-%s", sum[:8], filepath.Base(localFilePath))
+		return filepath.Join(dir, name+partSuffix), filepath.Join(dir, name+partMetaSuffix)
+	default:
+		return localFilePath + partSuffix, localFilePath + partMetaSuffix
+	}
+}
+
+// defaultStagingDir returns .<name>.staging next to the download folder. It
+// is outside the watched tree but usually on the same file system, so the
+// final rename stays atomic.
+func defaultStagingDir() string {
+	folder, err := filepath.Abs(download_folder)
+	if err != nil {
+		folder = filepath.Clean(download_folder)
+	}
+	return filepath.Join(filepath.Dir(folder), "."+filepath.Base(folder)+".staging")
+}
+
+// moveIntoPlace renames a complete download to its final name. Across file
+// systems the file is copied next to the destination first, so the final name
+// still only ever refers to a complete file.
+func moveIntoPlace(partPath, localFilePath string) error {
+	if partPath == localFilePath {
+		return nil
+	}
+	err := os.Rename(partPath, localFilePath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmpPath := localFilePath + partSuffix
+	if err := copyFileSync(partPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, localFilePath); err != nil {
+		return err
+	}
+	return os.Remove(partPath)
+}
+
+func copyFileSync(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir flushes a directory so that a rename into it survives a crash.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		logger.Debugf("Error syncing directory %s: %v\n", dir, err)
+	}
+}
+
+// partMeta describes the remote file a .part file is a prefix of. A partial
+// download is only resumed when the remote file still matches it.
+type partMeta struct {
+	Connection string    `json:"connection"`
+	RemotePath string    `json:"remote_path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+
+	// Segments of a segmented download, see segmentedDownload
+	Segments []segmentState `json:"segments,omitempty"`
+}
+
+func newPartMeta(conn Connection, file RemoteEntry, remoteFilePath string) partMeta {
+	return partMeta{
+		Connection: conn.Name,
+		RemotePath: remoteFilePath,
+		Size:       file.Size,
+		ModTime:    file.ModTime.UTC(),
+	}
+}
+
+func readPartMeta(metaPath string) (partMeta, error) {
+	var meta partMeta
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writePartMeta(metaPath string, meta partMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0644)
+}
+
+// resumeOffset returns how much of partPath can be kept for the download
+// described by meta. Partial files without matching metadata are discarded.
+func resumeOffset(partPath, metaPath string, meta partMeta) int64 {
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return 0
+	}
+	previous, ok := matchingPartMeta(partPath, metaPath, meta)
+	// A segmented download is not a prefix of the file
+	if !ok || len(previous.Segments) > 0 || info.Size() > meta.Size {
+		return 0
+	}
+	return info.Size()
+}
+
+// matchingPartMeta reads the metadata of an earlier attempt and reports
+// whether it was a download of the same, unchanged remote file.
+func matchingPartMeta(partPath, metaPath string, meta partMeta) (partMeta, bool) {
+	previous, err := readPartMeta(metaPath)
+	if err != nil {
+		logger.Debugf("No usable metadata for %s, restarting download: %v\n", partPath, err)
+		return previous, false
+	}
+	if previous.Connection != meta.Connection || previous.RemotePath != meta.RemotePath ||
+		previous.Size != meta.Size || !previous.ModTime.Equal(meta.ModTime) {
+		logger.Infof("Remote file changed since partial download of %s, restarting\n", meta.RemotePath)
+		return previous, false
+	}
+	return previous, true
+}
+
+// removePart deletes a partial download and its metadata.
+func removePart(partPath, metaPath string) {
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("Error deleting partial file: %v\n", err)
+	}
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("Error deleting partial file metadata: %v\n", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableDownloadPartValidation(t *testing.T) {
+	root := t.TempDir()
+	remote := filepath.Join(root, "data.bin")
+	if err := os.WriteFile(remote, []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	conn := Connection{Name: "local", Path: root}
+	file := RemoteEntry{Name: "data.bin", Size: 10, ModTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+
+	for _, tc := range []struct {
+		name string
+		meta *partMeta
+		want string
+	}{
+		{"matching metadata", &partMeta{Connection: "local", RemotePath: remote, Size: 10, ModTime: file.ModTime}, "XXXX456789"},
+		{"remote file changed", &partMeta{Connection: "local", RemotePath: remote, Size: 10, ModTime: file.ModTime.Add(-time.Hour)}, "0123456789"},
+		{"other connection", &partMeta{Connection: "other", RemotePath: remote, Size: 10, ModTime: file.ModTime}, "0123456789"},
+		{"missing metadata", nil, "0123456789"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			local := filepath.Join(t.TempDir(), "data.bin")
+			if err := os.WriteFile(local+partSuffix, []byte("XXXX"), 0644); err != nil {
+				t.Fatalf("Failed to write partial file: %v", err)
+			}
+			if tc.meta != nil {
+				if err := writePartMeta(local+partMetaSuffix, *tc.meta); err != nil {
+					t.Fatalf("Failed to write metadata: %v", err)
+				}
+			}
+
+			if _, err := resumableDownload(&ManagerLocal{}, conn, file, remote, local); err != nil {
+				t.Fatalf("resumableDownload failed: %v", err)
+			}
+			data, err := os.ReadFile(local)
+			if err != nil || string(data) != tc.want {
+				t.Errorf("Expected %q, got %q (err: %v)", tc.want, data, err)
+			}
+			for _, leftover := range []string{local + partSuffix, local + partMetaSuffix} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to be removed after a complete download", leftover)
+				}
+			}
+		})
+	}
+}
+
+func TestResumableDownloadKeepsShortPart(t *testing.T) {
+	root := t.TempDir()
+	remote := filepath.Join(root, "data.bin")
+	if err := os.WriteFile(remote, []byte("01234"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// The listing announced more data than the server delivered
+	file := RemoteEntry{Name: "data.bin", Size: 10}
+	local := filepath.Join(t.TempDir(), "data.bin")
+
+	if _, err := resumableDownload(&ManagerLocal{}, Connection{Name: "local"}, file, remote, local); err == nil {
+		t.Fatalf("Expected a size mismatch error")
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("Expected no file under the final name")
+	}
+	if data, err := os.ReadFile(local + partSuffix); err != nil || string(data) != "01234" {
+		t.Errorf("Expected the partial file to be kept for resume, got %q (err: %v)", data, err)
+	}
+}
+
+// observingManager serves one file and lists the destination folder while
+// the file is being read.
+type observingManager struct {
+	fakeManager
+	watchDir string
+	seen     []string
+}
+
+func (fm *observingManager) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	rc, err := fm.fakeManager.openFile(remotePath, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &observingReader{ReadCloser: rc, fm: fm}, nil
+}
+
+type observingReader struct {
+	io.ReadCloser
+	fm       *observingManager
+	observed bool
+}
+
+func (r *observingReader) Read(p []byte) (int, error) {
+	if !r.observed {
+		r.observed = true
+		entries, _ := os.ReadDir(r.fm.watchDir)
+		for _, entry := range entries {
+			r.fm.seen = append(r.fm.seen, entry.Name())
+		}
+	}
+	return r.ReadCloser.Read(p)
+}
+
+func TestResumableDownloadDeliveryModes(t *testing.T) {
+	for _, tc := range []struct {
+		delivery string
+		visible  []string
+	}{
+		{deliveryPart, []string{"report.csv.part", "report.csv.part.meta"}},
+		{deliveryStaging, nil},
+		{deliveryDirect, []string{"report.csv", "report.csv.part.meta"}},
+	} {
+		t.Run(tc.delivery, func(t *testing.T) {
+			download_folder = t.TempDir()
+			destDir := filepath.Join(download_folder, "partner")
+			if err := os.MkdirAll(destDir, 0755); err != nil {
+				t.Fatalf("Failed to create folder: %v", err)
+			}
+			staging := t.TempDir()
+			conn := Connection{Name: "partner", Delivery: tc.delivery}
+			if tc.delivery == deliveryStaging {
+				conn.StagingDir = staging
+			}
+			if err := validateDelivery(conn); err != nil {
+				t.Fatalf("validateDelivery failed: %v", err)
+			}
+
+			fm := &observingManager{fakeManager: fakeManager{files: map[string][]byte{"/out/report.csv": []byte("a,b\n")}}, watchDir: destDir}
+			file := RemoteEntry{Name: "report.csv", Size: 4}
+			local := filepath.Join(destDir, "report.csv")
+			if _, err := resumableDownload(fm, conn, file, "/out/report.csv", local); err != nil {
+				t.Fatalf("resumableDownload failed: %v", err)
+			}
+
+			if strings.Join(fm.seen, ",") != strings.Join(tc.visible, ",") {
+				t.Errorf("Expected %v in the destination folder during download, got %v", tc.visible, fm.seen)
+			}
+			data, err := os.ReadFile(local)
+			if err != nil || string(data) != "a,b\n" {
+				t.Errorf("Unexpected content %q (err: %v)", data, err)
+			}
+			leftovers, _ := os.ReadDir(staging)
+			if len(leftovers) != 0 {
+				t.Errorf("Expected empty staging directory, got %d entries", len(leftovers))
+			}
+		})
+	}
+}
+
+func TestValidateDelivery(t *testing.T) {
+	if err := validateDelivery(Connection{Name: "c", Delivery: "copy"}); err == nil {
+		t.Errorf("Expected error for unknown delivery mode")
+	}
+	if err := validateDelivery(Connection{Name: "c", StagingDir: "/tmp/staging"}); err == nil {
+		t.Errorf("Expected error for staging_dir without delivery staging")
+	}
+}
+
+func TestDefaultStagingDirOutsideDownloadFolder(t *testing.T) {
+	download_folder = filepath.Join(t.TempDir(), "downloads")
+	part, meta := partPaths(Connection{Delivery: deliveryStaging}, filepath.Join(download_folder, "partner", "report.csv"))
+	want := filepath.Join(filepath.Dir(download_folder), ".downloads.staging")
+	if filepath.Dir(part) != want || filepath.Dir(meta) != want {
+		t.Errorf("Expected staging files in %s, got %s and %s", want, part, meta)
+	}
+	if strings.HasPrefix(part, download_folder+string(filepath.Separator)) {
+		t.Errorf("Staging file %s is inside the download folder", part)
+	}
+}
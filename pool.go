@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxConcurrency caps the concurrency setting of a connection.
+const maxConcurrency = 64
+
+// concurrentManager is implemented by backends whose connection can serve
+// several transfers at once, such as SFTP with its pipelined request streams.
+// Other backends get a connection per worker.
+type concurrentManager interface {
+	concurrentSafe()
+}
+
+// transferPool runs the transfers of one connection on conn.Concurrency
+// workers. With a concurrency of 1 jobs run inline on the calling goroutine.
+type transferPool struct {
+	inline Manager
+	jobs   chan func(Manager)
+	wg     sync.WaitGroup
+	extra  []Manager
+}
+
+func newTransferPool(fm Manager, conn Connection) *transferPool {
+	p := &transferPool{}
+	if conn.Concurrency <= 1 {
+		p.inline = fm
+		return p
+	}
+
+	var managers []Manager
+	if _, ok := fm.(concurrentManager); ok {
+		for i := 0; i < conn.Concurrency; i++ {
+			managers = append(managers, fm)
+		}
+	} else {
+		// fm keeps listing folders, so every worker needs its own connection
+		p.extra = openWorkerConnections(conn, conn.Concurrency)
+		managers = p.extra
+	}
+	if len(managers) == 0 {
+		p.inline = fm
+		return p
+	}
+
+	logger.Debugf("Starting %d transfer workers for %s\n", len(managers), conn.Name)
+	p.jobs = make(chan func(Manager))
+	for _, m := range managers {
+		p.wg.Add(1)
+		go func(m Manager) {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job(m)
+			}
+		}(m)
+	}
+	return p
+}
+
+// openWorkerConnections opens up to n extra connections. Workers that cannot
+// connect are skipped, leaving the remaining ones to do the work.
+func openWorkerConnections(conn Connection, n int) []Manager {
+	backend, ok := lookupBackend(conn.Protocol)
+	if !ok {
+		return nil
+	}
+	var managers []Manager
+	for i := 0; i < n; i++ {
+		m := backend.New()
+		if err := connectManager(m, conn); err != nil {
+			logger.Warnf("Error opening transfer connection %d for %s: %v\n", i+1, conn.Name, err)
+			continue
+		}
+		managers = append(managers, m)
+	}
+	return managers
+}
+
+// submit runs job on a free worker, blocking while all of them are busy.
+func (p *transferPool) submit(job func(Manager)) {
+	if p.jobs == nil {
+		job(p.inline)
+		return
+	}
+	p.jobs <- job
+}
+
+// wait blocks until all submitted jobs are done and closes the connections
+// opened for the workers.
+func (p *transferPool) wait() {
+	if p.jobs != nil {
+		close(p.jobs)
+		p.wg.Wait()
+	}
+	for _, m := range p.extra {
+		m.close()
+	}
+}
+
+// inFlight holds the files currently being transferred so that concurrent
+// workers never pick up the same file twice before it is in the database.
+var inFlight = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+func transferKey(serverName, fileName string, fileSize int64) string {
+	return fmt.Sprintf("%s\x00%s\x00%d", serverName, fileName, fileSize)
+}
+
+// claimTransfer reserves key and reports whether it was free.
+func claimTransfer(key string) bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.keys[key] {
+		return false
+	}
+	inFlight.keys[key] = true
+	return true
+}
+
+func releaseTransfer(key string) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	delete(inFlight.keys, key)
+}
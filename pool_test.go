@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, root string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		name := filepath.Join(root, fmt.Sprintf("file%02d.txt", i))
+		if err := os.WriteFile(name, []byte(fmt.Sprintf("content %d", i)), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+}
+
+func checkDownloadedFiles(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		data, err := os.ReadFile(filepath.Join(download_folder, name))
+		if err != nil || string(data) != fmt.Sprintf("content %d", i) {
+			t.Errorf("Unexpected content for %s: %q (err: %v)", name, data, err)
+		}
+	}
+	var count int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM downloaded_files").Scan(&count); err != nil || count != n {
+		t.Errorf("Expected %d database entries, got %d (err: %v)", n, count, err)
+	}
+}
+
+func TestConcurrentFTPDownload(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, 12)
+	srv := startTestFTPServer(t, root, nil, false)
+	setupTestDB(t)
+	download_folder = t.TempDir()
+
+	conn := Connection{
+		Name: "ftp_pool", Host: "127.0.0.1", Port: srv.port(), Protocol: "ftp",
+		Username: "user", Password: "pass", Path: "/", Depth: 1, Concurrency: 3,
+	}
+	handleDownload(conn, &ManagerFTP{})
+
+	checkDownloadedFiles(t, 12)
+	// One control connection for listing and one per worker
+	if logins := srv.count("USER"); logins != 4 {
+		t.Errorf("Expected 4 FTP logins, got %d", logins)
+	}
+}
+
+func TestConcurrentSFTPDownload(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, 12)
+	srv := newTestSSHServer(t, root)
+	srv.start(t)
+	setupTestDB(t)
+	download_folder = t.TempDir()
+
+	conn := Connection{
+		Name: "sftp_pool", Host: "127.0.0.1", Port: srv.port(), Protocol: "sftp",
+		Username: "user", Password: "pass", Path: ".", Depth: 1, Concurrency: 4,
+	}
+	handleDownload(conn, &ManagerSFTP{})
+
+	checkDownloadedFiles(t, 12)
+}
+
+func TestClaimTransfer(t *testing.T) {
+	key := transferKey("conn", "file.txt", 10)
+	other := transferKey("conn", "file.txt", 11)
+	t.Cleanup(func() {
+		releaseTransfer(key)
+		releaseTransfer(other)
+	})
+	if !claimTransfer(key) {
+		t.Fatalf("Expected first claim to succeed")
+	}
+	if claimTransfer(key) {
+		t.Errorf("Expected second claim of the same file to fail")
+	}
+	if !claimTransfer(other) {
+		t.Errorf("Expected a file with another size to be claimable")
+	}
+	releaseTransfer(key)
+	if !claimTransfer(key) {
+		t.Errorf("Expected claim to succeed after release")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Remote post actions applied to a source file once it was transferred.
+const (
+	postNone    = "none"
+	postDelete  = "delete"
+	postArchive = "archive"
+	postRename  = "rename"
+)
+
+const defaultRenameSuffix = ".processed"
+
+// renamer is implemented by backends that can move files on the server,
+// which the archive and rename post actions require.
+type renamer interface {
+	Manager
+	makeDir(remotePath string) error
+	rename(oldPath, newPath string) error
+}
+
+func validatePostAction(conn Connection) error {
+	switch conn.PostAction {
+	case "", postNone, postDelete:
+	case postArchive:
+		if conn.ArchiveDir == "" {
+			return fmt.Errorf("archive_dir is missing for %s", conn.Name)
+		}
+		// The archive must resolve against the same base as the walked
+		// folders, or it could not be recognised and skipped
+		if path.IsAbs(conn.ArchiveDir) && !path.IsAbs(conn.Path) {
+			return fmt.Errorf("archive_dir for %s must be relative when path is relative", conn.Name)
+		}
+	case postRename:
+	default:
+		return fmt.Errorf("invalid post_action for %s: %s", conn.Name, conn.PostAction)
+	}
+	if conn.PostAction != "" && conn.Direction == directionUpload {
+		return fmt.Errorf("post_action is not supported for uploads: %s", conn.Name)
+	}
+	if conn.Remove && conn.PostAction != "" && conn.PostAction != postDelete {
+		return fmt.Errorf("remove and post_action %s are mutually exclusive for %s", conn.PostAction, conn.Name)
+	}
+	if conn.PostAction == postArchive || conn.PostAction == postRename {
+		backend, _ := lookupBackend(conn.Protocol)
+		if _, ok := backend.New().(renamer); !ok {
+			return fmt.Errorf("protocol %s does not support post_action %s for %s", conn.Protocol, conn.PostAction, conn.Name)
+		}
+	}
+	return nil
+}
+
+// postAction returns the action configured for conn. remove: true is the
+// older spelling of post_action: delete.
+func postAction(conn Connection) string {
+	if conn.PostAction != "" {
+		return conn.PostAction
+	}
+	if conn.Remove {
+		return postDelete
+	}
+	return postNone
+}
+
+// isPostActionResult reports whether name is a file renamed by the rename
+// post action, which must not be picked up again.
+func isPostActionResult(conn Connection, name string) bool {
+	return conn.PostAction == postRename && strings.HasSuffix(name, renameSuffix(conn))
+}
+
+func renameSuffix(conn Connection) string {
+	if conn.RenameSuffix != "" {
+		return conn.RenameSuffix
+	}
+	return defaultRenameSuffix
+}
+
+// archiveDir returns the archive folder of conn. A relative archive_dir is
+// relative to the connection path.
+func archiveDir(conn Connection) string {
+	if path.IsAbs(conn.ArchiveDir) {
+		return path.Clean(conn.ArchiveDir)
+	}
+	return path.Join(conn.Path, conn.ArchiveDir)
+}
+
+// postActionTarget returns where the archive or rename action moves
+// remoteFilePath to. Archived files go below ArchiveDir, in date folders
+// when ArchiveDateFormat is set.
+func postActionTarget(conn Connection, remoteFilePath string, now time.Time) string {
+	if conn.PostAction == postRename {
+		return remoteFilePath + renameSuffix(conn)
+	}
+	dir := archiveDir(conn)
+	if conn.ArchiveDateFormat != "" {
+		dir = path.Join(dir, now.Format(conn.ArchiveDateFormat))
+	}
+	return path.Join(dir, path.Base(remoteFilePath))
+}
+
+// applyVerifiedPostAction applies the post action unless conn verifies
+// checksums and sum could not be verified, in which case the file is left
+// in place and "<action> skipped" is recorded.
+func applyVerifiedPostAction(fm Manager, conn Connection, remoteFilePath string, sum fileChecksum, now time.Time) (string, string) {
+	if postAction(conn) != postNone && conn.Checksum != "" && !sum.Verified {
+		logger.Warnf("File left on server, checksum not verified: %s\n", remoteFilePath)
+		return postAction(conn) + " skipped", ""
+	}
+	return applyPostAction(fm, conn, remoteFilePath, now)
+}
+
+// applyPostAction deletes, archives or renames a transferred source file and
+// returns the outcome recorded in the database: the action, suffixed with
+// " failed" when the server refused it, and the new path of moved files.
+func applyPostAction(fm Manager, conn Connection, remoteFilePath string, now time.Time) (string, string) {
+	action := postAction(conn)
+	switch action {
+	case postNone:
+		logger.Debugf("File not removed from server as per configuration: %s\n", remoteFilePath)
+		return action, ""
+	case postDelete:
+		if err := fm.deleteFile(remoteFilePath); err != nil {
+			logger.Errorf("Error deleting file from server: %v\n", err)
+			return action + " failed", ""
+		}
+		logger.Debugf("Deleted file from server: %s\n", remoteFilePath)
+		return action, ""
+	}
+
+	// Checked by validatePostAction
+	rn := fm.(renamer)
+	target := postActionTarget(conn, remoteFilePath, now)
+	if action == postArchive {
+		if err := rn.makeDir(path.Dir(target)); err != nil {
+			logger.Errorf("Error creating archive folder on server: %v\n", err)
+			return action + " failed", ""
+		}
+	}
+	if err := rn.rename(remoteFilePath, target); err != nil {
+		logger.Errorf("Error moving file on server to %s: %v\n", target, err)
+		return action + " failed", ""
+	}
+	logger.Debugf("Moved file on server: %s -> %s\n", remoteFilePath, target)
+	return action, target
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostActionArchive(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.csv"), []byte("alpha"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	conn := Connection{
+		Name:              "archive_test",
+		Protocol:          "local",
+		Path:              src,
+		Depth:             2,
+		PostAction:        postArchive,
+		ArchiveDir:        filepath.Join(src, "archive"),
+		ArchiveDateFormat: "2006/01/02",
+	}
+	if err := validatePostAction(conn); err != nil {
+		t.Fatalf("validatePostAction failed: %v", err)
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerLocal{})
+
+	archived := filepath.Join(src, "archive", time.Now().Format("2006/01/02"), "a.csv")
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("Expected the file to be archived on the server: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "a.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be moved out of the source folder")
+	}
+	files, err := searchDownloadedFileEntries(db.conn, "a.csv", 5, conn.Name)
+	if err != nil || len(files) != 1 || files[0].PostAction != postArchive || files[0].PostActionPath != archived {
+		t.Fatalf("Expected the archive to be recorded, got %+v (err: %v)", files, err)
+	}
+
+	// The archive is inside the source folder but never walked
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerLocal{})
+	if entries, _ := os.ReadDir(download_folder); len(entries) != 0 {
+		t.Errorf("Expected the archive not to be downloaded, got %v", entries)
+	}
+}
+
+func TestPostActionArchiveFTPRelative(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "in"), 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "in", "a.csv"), []byte("alpha"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	srv := startTestFTPServer(t, root, nil, false)
+	conn := Connection{
+		Name: "ftp_archive", Host: "127.0.0.1", Port: srv.port(), Protocol: "ftp",
+		Username: "user", Password: "pass", Path: "in", Depth: 3,
+		PostAction: postArchive, ArchiveDir: "archive", ArchiveDateFormat: "2006-01",
+	}
+	if err := validatePostAction(conn); err != nil {
+		t.Fatalf("validatePostAction failed: %v", err)
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerFTP{})
+
+	month := time.Now().Format("2006-01")
+	if _, err := os.Stat(filepath.Join(root, "in", "archive", month, "a.csv")); err != nil {
+		t.Fatalf("Expected the file to be archived below the connection path: %v", err)
+	}
+	if rnto := srv.args("RNTO"); len(rnto) != 1 || rnto[0] != path.Join("in", "archive", month, "a.csv") {
+		t.Errorf("Unexpected RNTO arguments: %v", rnto)
+	}
+
+	// The relative archive inside the relative path is never walked, even
+	// when its files are not known from an earlier download
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerFTP{})
+	if entries, _ := os.ReadDir(download_folder); len(entries) != 0 {
+		t.Errorf("Expected the archive not to be downloaded, got %v", entries)
+	}
+}
+
+func TestPostActionRename(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.csv"), []byte("alpha"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	conn := Connection{Name: "rename_test", Protocol: "local", Path: src, Depth: 1, PostAction: postRename}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerLocal{})
+	handleDownload(conn, &ManagerLocal{})
+
+	if _, err := os.Stat(filepath.Join(src, "a.csv"+defaultRenameSuffix)); err != nil {
+		t.Fatalf("Expected the file to be renamed on the server: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "a.csv"+defaultRenameSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Expected the renamed file not to be picked up again")
+	}
+}
+
+func TestPostActionDeleteFailureRecorded(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &readOnlyManager{fakeManager{files: map[string][]byte{"/in/a.csv": []byte("alpha")}}}
+	conn := Connection{Name: "readonly", Path: "/in", Depth: 1, Remove: true}
+
+	handleDownload(conn, fm)
+	files, err := searchDownloadedFileEntries(db.conn, "a.csv", 5, conn.Name)
+	if err != nil || len(files) != 1 || files[0].PostAction != postDelete+" failed" {
+		t.Fatalf("Expected the failed delete to be recorded, got %+v (err: %v)", files, err)
+	}
+}
+
+// readOnlyManager refuses deletes like a read-only partner account.
+type readOnlyManager struct {
+	fakeManager
+}
+
+func (fm *readOnlyManager) deleteFile(remotePath string) error {
+	return os.ErrPermission
+}
+
+func TestValidatePostAction(t *testing.T) {
+	for _, conn := range []Connection{
+		{Name: "p", Protocol: "local", PostAction: "move"},
+		{Name: "p", Protocol: "local", PostAction: postArchive},
+		{Name: "p", Protocol: "local", Path: "in", PostAction: postArchive, ArchiveDir: "/archive"},
+		{Name: "p", Protocol: "local", PostAction: postRename, Remove: true},
+		{Name: "p", Protocol: "local", PostAction: postDelete, Direction: directionUpload},
+	} {
+		if err := validatePostAction(conn); err == nil {
+			t.Errorf("Expected %+v to be rejected", conn)
+		}
+	}
+}
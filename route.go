@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// spoolSumSuffix names the file kept next to a spool copy with the checksum
+// result of its download, so that a copy left by an earlier pass is still
+// known to be verified or not.
+const spoolSumSuffix = ".sum"
+
+// Route relays files from one source connection to one or more destination
+// connections. Files are spooled locally once and the source remove policy is
+// applied only after every destination has received the file.
+type Route struct {
+	Name         string   `yaml:"name"`
+	Source       string   `yaml:"source"`
+	Destinations []string `yaml:"destinations"`
+	Delay        int      `yaml:"delay"`
+}
+
+// routeDestination is a destination connection opened for one relay run.
+type routeDestination struct {
+	conn Connection
+	fm   uploader
+}
+
+func validateRoutes(config Config) error {
+	conns := make(map[string]Connection, len(config.Connections))
+	for _, conn := range config.Connections {
+		conns[conn.Name] = conn
+	}
+
+	names := make(map[string]bool, len(config.Routes))
+	for _, route := range config.Routes {
+		if route.Name == "" {
+			return fmt.Errorf("route name is missing")
+		}
+		if names[route.Name] {
+			return fmt.Errorf("duplicate route name: %s", route.Name)
+		}
+		names[route.Name] = true
+
+		source, ok := conns[route.Source]
+		if !ok {
+			return fmt.Errorf("unknown source connection for route %s: %s", route.Name, route.Source)
+		}
+		if source.Direction == directionUpload {
+			return fmt.Errorf("source %s of route %s is an upload connection", route.Source, route.Name)
+		}
+		if len(route.Destinations) == 0 {
+			return fmt.Errorf("destinations are missing for route %s", route.Name)
+		}
+		for _, name := range route.Destinations {
+			dest, ok := conns[name]
+			if !ok {
+				return fmt.Errorf("unknown destination connection for route %s: %s", route.Name, name)
+			}
+			if name == route.Source {
+				return fmt.Errorf("route %s uses %s as source and destination", route.Name, name)
+			}
+			backend, ok := lookupBackend(dest.Protocol)
+			if !ok {
+				return fmt.Errorf("unsupported protocol %s for destination %s of route %s", dest.Protocol, name, route.Name)
+			}
+			if _, ok := backend.New().(uploader); !ok {
+				return fmt.Errorf("protocol %s does not support uploads for route %s", dest.Protocol, route.Name)
+			}
+		}
+		if route.Delay < 0 {
+			return fmt.Errorf("invalid delay for route %s: %d", route.Name, route.Delay)
+		}
+	}
+	return nil
+}
+
+// routeConnectionNames returns the connections used by routes. They are
+// driven by their routes and not polled on their own.
+func routeConnectionNames(config Config) map[string]bool {
+	names := make(map[string]bool)
+	for _, route := range config.Routes {
+		names[route.Source] = true
+		for _, name := range route.Destinations {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func handleRoute(route Route, conns map[string]Connection) {
+	for {
+		logger.Debugf("=== Route: %s, Source: %s, Destinations: %v\n", route.Name, route.Source, route.Destinations)
+		relayRoute(route, conns)
+		time.Sleep(time.Duration(route.Delay) * time.Second)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// relayRoute runs a single pass of a route over its source connection.
+func relayRoute(route Route, conns map[string]Connection) {
+	source := conns[route.Source]
+	backend, ok := lookupBackend(source.Protocol)
+	if !ok {
+		logger.Errorf("Unsupported protocol for %s: %s\n", source.Name, source.Protocol)
+		return
+	}
+
+	fm := backend.New()
+	if err := connectManager(fm, source); err != nil {
+		logger.Debugf("Error connecting to %s: %v\n", source.Protocol, err)
+		return
+	}
+	defer fm.close()
+
+	// Destinations that cannot be reached stay pending and are retried on
+	// the next pass
+	var dests []routeDestination
+	for _, name := range route.Destinations {
+		conn := conns[name]
+		destBackend, _ := lookupBackend(conn.Protocol)
+		up, ok := destBackend.New().(uploader)
+		if !ok {
+			continue
+		}
+		if err := connectManager(up, conn); err != nil {
+			logger.Errorf("Error connecting to destination %s of route %s: %v\n", name, route.Name, err)
+			dests = append(dests, routeDestination{conn: conn})
+			continue
+		}
+		defer up.close()
+		dests = append(dests, routeDestination{conn: conn, fm: up})
+	}
+
+	spoolDir := path.Join(download_folder, ".spool", route.Name)
+	filter := newFileFilter(source, time.Now())
+	complete := true
+	err := walkRemote(fm, source.Path, "", source.Depth, filter, func(file RemoteEntry, remoteFilePath, relPath string, dir []RemoteEntry) {
+		if !relayEntry(route, source, file, remoteFilePath, relPath, path.Join(spoolDir, relPath), dir, fm, dests) {
+			complete = false
+		}
+	})
+	if err != nil {
+		logger.Debugf("Error relaying files: %v\n", err)
+	} else if complete {
+		filter.finishRun()
+	}
+}
+
+// relayEntry spools one source file and delivers it to every destination that
+// has not received it yet. dir is the listing of the file's folder. The
+// result reports whether the file is done with, i.e. skipped or delivered
+// everywhere.
+func relayEntry(route Route, source Connection, file RemoteEntry, remoteFilePath, relPath, spoolPath string, dir []RemoteEntry, fm Manager, dests []routeDestination) bool {
+	if isChecksumSidecar(source, file.Name) || isMarker(source, file.Name) {
+		return true
+	}
+	db.mu.Lock()
+	deliveries, err := searchRouteDeliveries(db.conn, route.Name, relPath, file.Size)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error searching for route deliveries: %v\n", err)
+		return false
+	}
+	delivered := make(map[string]bool, len(deliveries))
+	for _, delivery := range deliveries {
+		delivered[delivery.Destination] = true
+	}
+
+	var pending []routeDestination
+	for _, dest := range dests {
+		if !delivered[dest.conn.Name] {
+			pending = append(pending, dest)
+		}
+	}
+
+	var sum fileChecksum
+	if len(pending) > 0 {
+		// Files relayed everywhere count as done even when their marker is gone
+		if !markerReleased(source, file, dir) {
+			return false
+		}
+		if !fileIsStable(source, file, remoteFilePath, time.Now()) {
+			return false
+		}
+		var ok bool
+		if sum, ok = spoolRouteFile(source, file, remoteFilePath, spoolPath, fm); !ok {
+			return false
+		}
+		for _, dest := range pending {
+			if dest.fm == nil {
+				continue
+			}
+			if deliverRouteFile(route, dest, file, relPath, spoolPath) {
+				delivered[dest.conn.Name] = true
+			}
+		}
+	} else {
+		logger.Warnf("File already relayed: %s\n", relPath)
+	}
+
+	for _, dest := range dests {
+		if !delivered[dest.conn.Name] {
+			logger.Debugf("File %s is still pending for destination %s\n", relPath, dest.conn.Name)
+			return false
+		}
+	}
+
+	// Every destination has the file, so the spool copy is no longer needed
+	removeSpoolFile(spoolPath)
+
+	if len(pending) == 0 {
+		// Retry the post action of a file relayed on an earlier pass, unless
+		// that pass left it in place for want of a verified checksum
+		if !relayedUnverified(route, source, file) {
+			applyPostAction(fm, source, remoteFilePath, time.Now())
+		}
+		return true
+	}
+	action, actionPath := applyVerifiedPostAction(fm, source, remoteFilePath, sum, time.Now())
+	finishSidecar(fm, source, file, remoteFilePath, dir, sum)
+	forgetPendingFile(source, remoteFilePath)
+
+	relayedFile := DownloadedFile{
+		FileName:       file.Name,
+		ServerName:     route.Name,
+		FileSize:       file.Size,
+		DownloadTime:   time.Now().Format("2006-01-02 15:04:05"),
+		Direction:      directionRelay,
+		Checksum:       sum.String(),
+		PostAction:     action,
+		PostActionPath: actionPath,
+	}
+
+	db.mu.Lock()
+	err = saveDownloadedFileEntry(db.conn, relayedFile)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Fatalf("Failed to save file entry: %v", err)
+	}
+	return true
+}
+
+// relayedUnverified reports whether the post action of a file relayed on an
+// earlier pass must not be applied because its checksum was not verified.
+func relayedUnverified(route Route, source Connection, file RemoteEntry) bool {
+	if source.Checksum == "" || postAction(source) == postNone {
+		return false
+	}
+	db.mu.Lock()
+	relayed, err := searchTransferEntries(db.conn, file.Name, file.Size, route.Name, directionRelay)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error searching for relayed file entries: %v\n", err)
+		return true
+	}
+	for _, entry := range relayed {
+		if !strings.HasSuffix(entry.PostAction, " skipped") {
+			return false
+		}
+	}
+	return true
+}
+
+// spoolRouteFile downloads the source file into the spool unless a complete
+// copy is already there from an earlier, partially delivered pass, and
+// returns the checksum result of the download.
+func spoolRouteFile(source Connection, file RemoteEntry, remoteFilePath, spoolPath string, fm Manager) (fileChecksum, bool) {
+	if info, err := os.Stat(spoolPath); err == nil && info.Size() == file.Size {
+		if sum, err := readSpoolChecksum(spoolPath); err == nil {
+			return sum, true
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(spoolPath), os.ModePerm); err != nil {
+		logger.Debugf("Error creating spool directory: %v\n", err)
+		return fileChecksum{}, false
+	}
+
+	sum, err := resumableDownload(fm, source, file, remoteFilePath, spoolPath)
+	if err != nil {
+		logger.Debugf("Error downloading file: %v\n", err)
+		return sum, false
+	}
+
+	info, err := os.Stat(spoolPath)
+	if err != nil {
+		logger.Debugf("Error stating spool file: %v\n", err)
+		return sum, false
+	}
+	if info.Size() != file.Size {
+		logger.Debugf("File size mismatch for %s: expected %d, got %d\n", file.Name, file.Size, info.Size())
+		removeSpoolFile(spoolPath)
+		return sum, false
+	}
+	if err := writeSpoolChecksum(spoolPath, sum); err != nil {
+		logger.Debugf("Error saving spool checksum: %v\n", err)
+		return sum, false
+	}
+	return sum, true
+}
+
+func readSpoolChecksum(spoolPath string) (fileChecksum, error) {
+	var sum fileChecksum
+	data, err := os.ReadFile(spoolPath + spoolSumSuffix)
+	if err != nil {
+		return sum, err
+	}
+	err = json.Unmarshal(data, &sum)
+	return sum, err
+}
+
+func writeSpoolChecksum(spoolPath string, sum fileChecksum) error {
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(spoolPath+spoolSumSuffix, data, 0644)
+}
+
+// removeSpoolFile deletes a spool copy along with its checksum result.
+func removeSpoolFile(spoolPath string) {
+	for _, name := range []string{spoolPath, spoolPath + spoolSumSuffix} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.Debugf("Error deleting spool file: %v\n", err)
+		}
+	}
+}
+
+// deliverRouteFile uploads the spooled file to one destination, verifies the
+// remote size and records the delivery.
+func deliverRouteFile(route Route, dest routeDestination, file RemoteEntry, relPath, spoolPath string) bool {
+	remoteFilePath := path.Join(dest.conn.Path, relPath)
+	if err := dest.fm.makeDir(path.Dir(remoteFilePath)); err != nil {
+		logger.Debugf("Error creating remote directory: %v\n", err)
+		return false
+	}
+
+	srcFile, err := os.Open(spoolPath)
+	if err != nil {
+		logger.Debugf("Error opening spool file: %v\n", err)
+		return false
+	}
+	err = dest.fm.writeFile(remoteFilePath, throttle(dest.conn, srcFile))
+	srcFile.Close()
+	if err != nil {
+		logger.Errorf("Error relaying %s to %s: %v\n", relPath, dest.conn.Name, err)
+		return false
+	}
+
+	remoteInfo, err := dest.fm.stat(remoteFilePath)
+	if err != nil {
+		logger.Debugf("Error getting remote file info: %v\n", err)
+		return false
+	}
+	if remoteInfo.Size != file.Size {
+		logger.Errorf("File size mismatch relaying %s to %s: expected %d, got %d\n", relPath, dest.conn.Name, file.Size, remoteInfo.Size)
+		if err := dest.fm.deleteFile(remoteFilePath); err != nil {
+			logger.Debugf("Error deleting invalid remote file: %v\n", err)
+		}
+		return false
+	}
+
+	logger.Infof("Relayed file: %s to %s\n", relPath, dest.conn.Name)
+
+	db.mu.Lock()
+	err = saveRouteDelivery(db.conn, RouteDelivery{
+		RouteName:    route.Name,
+		Destination:  dest.conn.Name,
+		FileName:     relPath,
+		FileSize:     file.Size,
+		DeliveryTime: time.Now().Format("2006-01-02 15:04:05"),
+	})
+	db.mu.Unlock()
+	if err != nil {
+		logger.Fatalf("Failed to save route delivery: %v", err)
+	}
+	return true
+}
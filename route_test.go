@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelayRoutePendingDestination(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "batch"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "batch", "invoice.pdf"), []byte("invoice"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	mirror := t.TempDir()
+	ftpRoot := t.TempDir()
+	srv := startTestFTPServer(t, ftpRoot, nil, false)
+
+	// A port nothing listens on makes the FTP destination unreachable
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	conns := map[string]Connection{
+		"src":    {Name: "src", Protocol: "local", Path: src, Depth: 2, Remove: true},
+		"mirror": {Name: "mirror", Protocol: "local", Path: mirror},
+		"ftp":    {Name: "ftp", Protocol: "ftp", Host: "127.0.0.1", Port: closedPort, Username: "user", Password: "pass", Path: "/in"},
+	}
+	route := Route{Name: "fanout", Source: "src", Destinations: []string{"mirror", "ftp"}}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	relayRoute(route, conns)
+
+	if _, err := os.Stat(filepath.Join(mirror, "batch", "invoice.pdf")); err != nil {
+		t.Errorf("Expected file to reach the reachable destination: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "batch", "invoice.pdf")); err != nil {
+		t.Errorf("Expected source to be kept while a destination is pending: %v", err)
+	}
+	spoolPath := filepath.Join(download_folder, ".spool", "fanout", "batch", "invoice.pdf")
+	if _, err := os.Stat(spoolPath); err != nil {
+		t.Errorf("Expected spool copy to be kept for the pending destination: %v", err)
+	}
+
+	ftp := conns["ftp"]
+	ftp.Port = srv.port()
+	conns["ftp"] = ftp
+	relayRoute(route, conns)
+
+	data, err := os.ReadFile(filepath.Join(ftpRoot, "in", "batch", "invoice.pdf"))
+	if err != nil || string(data) != "invoice" {
+		t.Errorf("Unexpected content at FTP destination %q (err: %v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "batch", "invoice.pdf")); !os.IsNotExist(err) {
+		t.Errorf("Expected source to be removed after all destinations succeeded")
+	}
+	if _, err := os.Stat(spoolPath); !os.IsNotExist(err) {
+		t.Errorf("Expected spool copy to be removed")
+	}
+
+	deliveries, err := searchRouteDeliveries(db.conn, "fanout", "batch/invoice.pdf", 7)
+	if err != nil || len(deliveries) != 2 {
+		t.Errorf("Expected one delivery per destination, got %v (err: %v)", deliveries, err)
+	}
+	relayed, err := searchTransferEntries(db.conn, "invoice.pdf", 7, "fanout", directionRelay)
+	if err != nil || len(relayed) != 1 {
+		t.Errorf("Expected relay to be recorded once, got %v (err: %v)", relayed, err)
+	}
+}
+
+func TestRelayRouteUnverifiedChecksum(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "invoice.pdf"), []byte("invoice"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	mirror := t.TempDir()
+	ftpRoot := t.TempDir()
+	srv := startTestFTPServer(t, ftpRoot, nil, false)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	// Local sources offer no server checksum and there is no sidecar
+	conns := map[string]Connection{
+		"src":    {Name: "src", Protocol: "local", Path: src, Depth: 1, Remove: true, Checksum: "sha256"},
+		"mirror": {Name: "mirror", Protocol: "local", Path: mirror},
+		"ftp":    {Name: "ftp", Protocol: "ftp", Host: "127.0.0.1", Port: closedPort, Username: "user", Password: "pass", Path: "/in"},
+	}
+	route := Route{Name: "unverified", Source: "src", Destinations: []string{"mirror", "ftp"}}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	relayRoute(route, conns)
+
+	// The second pass delivers from the spool copy of the first one
+	ftp := conns["ftp"]
+	ftp.Port = srv.port()
+	conns["ftp"] = ftp
+	relayRoute(route, conns)
+	relayRoute(route, conns)
+
+	if _, err := os.Stat(filepath.Join(ftpRoot, "in", "invoice.pdf")); err != nil {
+		t.Fatalf("Expected the file to reach every destination: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "invoice.pdf")); err != nil {
+		t.Errorf("Expected source with an unverified checksum to be kept: %v", err)
+	}
+	relayed, err := searchTransferEntries(db.conn, "invoice.pdf", 7, "unverified", directionRelay)
+	if err != nil || len(relayed) != 1 || relayed[0].PostAction != postDelete+" skipped" || !strings.HasPrefix(relayed[0].Checksum, "sha256:") {
+		t.Errorf("Expected the skipped delete and checksum to be recorded, got %+v (err: %v)", relayed, err)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	config := Config{
+		Connections: []Connection{
+			{Name: "a", Protocol: "local", Path: "/a"},
+			{Name: "b", Protocol: "local", Path: "/b"},
+		},
+		Routes: []Route{{Name: "r", Source: "a", Destinations: []string{"b"}}},
+	}
+	if err := validateRoutes(config); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	config.Routes[0].Destinations = []string{"missing"}
+	if err := validateRoutes(config); err == nil {
+		t.Errorf("Expected error for unknown destination")
+	}
+
+	config.Routes[0].Destinations = []string{"b"}
+	config.Connections[0].Direction = directionUpload
+	if err := validateRoutes(config); err == nil {
+		t.Errorf("Expected error for an upload connection as source")
+	}
+
+	config.Connections[0].Direction = ""
+	registerTestBackend(t, "fake-readonly", Backend{New: func() Manager { return &fakeManager{} }})
+	config.Connections[1].Protocol = "fake-readonly"
+	if err := validateRoutes(config); err == nil {
+		t.Errorf("Expected error for a destination that cannot receive files")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ManagerS3 reads objects from an S3-compatible bucket. Remote paths are
+// object key prefixes and "/" separated key segments are treated as folders.
+type ManagerS3 struct {
+	client *minio.Client
+	bucket string
+}
+
+func validateS3(conn Connection) error {
+	if conn.Bucket == "" {
+		return fmt.Errorf("bucket is missing for %s", conn.Name)
+	}
+	if (conn.AccessKey == "") != (conn.SecretKey == "") {
+		return fmt.Errorf("access_key and secret_key must be set together for %s", conn.Name)
+	}
+	if conn.Endpoint != "" {
+		if _, _, err := parseS3Endpoint(conn.Endpoint); err != nil {
+			return fmt.Errorf("invalid endpoint for %s: %v", conn.Name, err)
+		}
+	}
+	return validateTLS(conn)
+}
+
+// parseS3Endpoint splits an endpoint such as "http://127.0.0.1:9000" into the
+// host:port expected by minio and whether TLS should be used. Endpoints
+// without a scheme default to HTTPS.
+func parseS3Endpoint(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, true, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", false, fmt.Errorf("host is missing")
+	}
+	return u.Host, u.Scheme == "https", nil
+}
+
+// s3Key converts a remote path into an object key without a leading slash.
+func s3Key(remotePath string) string {
+	key := strings.TrimPrefix(path.Clean("/"+remotePath), "/")
+	return key
+}
+
+func (fm *ManagerS3) connect(conn Connection) error {
+	endpoint := conn.Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	host, secure, err := parseS3Endpoint(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	logger.Debugf("Connecting to S3: Endpoint: %s, Bucket: %s\n", host, conn.Bucket)
+
+	// Fall back to the usual environment and instance credentials when no
+	// static keys are configured
+	var creds *credentials.Credentials
+	if conn.AccessKey != "" {
+		creds = credentials.NewStaticV4(conn.AccessKey, conn.SecretKey, conn.SessionToken)
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 transport: %v", err)
+	}
+	if secure {
+		tlsConfig, err := buildTLSConfig(conn)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %v", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if err := applyProxy(transport, conn); err != nil {
+		return err
+	}
+
+	client, err := minio.New(host, &minio.Options{
+		Creds:     creds,
+		Secure:    secure,
+		Region:    conn.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, conn.Bucket)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket %s: %v", conn.Bucket, err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", conn.Bucket)
+	}
+
+	fm.client = client
+	fm.bucket = conn.Bucket
+	logger.Debugf("Connected to S3: %s\n", conn.Name)
+	return nil
+}
+
+func (fm *ManagerS3) readDir(remotePath string) ([]RemoteEntry, error) {
+	prefix := s3Key(remotePath)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []RemoteEntry
+	for object := range fm.client.ListObjects(context.Background(), fm.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("error reading directory: %v", object.Err)
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if name == "" {
+			// Zero-byte "folder" placeholder objects created by some clients
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			entries = append(entries, RemoteEntry{Name: strings.TrimSuffix(name, "/"), Kind: EntryFolder})
+			continue
+		}
+		entries = append(entries, RemoteEntry{
+			Name:    name,
+			Size:    object.Size,
+			ModTime: object.LastModified,
+			Kind:    EntryFile,
+		})
+	}
+	return entries, nil
+}
+
+func (fm *ManagerS3) openFile(remotePath string, offset int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	object, err := fm.client.GetObject(context.Background(), fm.bucket, s3Key(remotePath), opts)
+	if err != nil {
+		return nil, fmt.Errorf("error opening remote object: %v", err)
+	}
+	// GetObject is lazy, so surface missing objects and range errors here
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if resp := minio.ToErrorResponse(err); resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, errResumeNotSupported
+		}
+		return nil, fmt.Errorf("error opening remote object: %v", err)
+	}
+	return object, nil
+}
+
+func (fm *ManagerS3) deleteFile(remotePath string) error {
+	err := fm.client.RemoveObject(context.Background(), fm.bucket, s3Key(remotePath), minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("error deleting object from S3: %v", err)
+	}
+	return nil
+}
+
+// rename copies the object to its new key and removes the old one, since S3
+// cannot move objects.
+func (fm *ManagerS3) rename(oldPath, newPath string) error {
+	_, err := fm.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: fm.bucket, Object: s3Key(newPath)},
+		minio.CopySrcOptions{Bucket: fm.bucket, Object: s3Key(oldPath)})
+	if err != nil {
+		return fmt.Errorf("error copying object in S3: %v", err)
+	}
+	return fm.deleteFile(oldPath)
+}
+
+// makeDir is a no-op because S3 has no folders, only key prefixes.
+func (fm *ManagerS3) makeDir(remotePath string) error {
+	return nil
+}
+
+func (fm *ManagerS3) writeFile(remotePath string, r io.Reader) error {
+	_, err := fm.client.PutObject(context.Background(), fm.bucket, s3Key(remotePath), r, -1, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("error uploading object to S3: %v", err)
+	}
+	return nil
+}
+
+func (fm *ManagerS3) stat(remotePath string) (RemoteEntry, error) {
+	info, err := fm.client.StatObject(context.Background(), fm.bucket, s3Key(remotePath), minio.StatObjectOptions{})
+	if err != nil {
+		return RemoteEntry{}, err
+	}
+	return RemoteEntry{Name: path.Base(info.Key), Size: info.Size, ModTime: info.LastModified, Kind: EntryFile}, nil
+}
+
+// The minio client is safe for concurrent use, so workers share it.
+func (fm *ManagerS3) concurrentSafe() {}
+
+func (fm *ManagerS3) close() error {
+	return nil
+}
+
+func init() {
+	registerBackend("s3", Backend{
+		Validate: validateS3,
+		New:      func() Manager { return &ManagerS3{} },
+	})
+}
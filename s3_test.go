@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the subset of the S3 API used by
+// ManagerS3: HeadBucket, ListObjectsV2, GetObject and DeleteObject.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	IsTruncated    bool
+	KeyCount       int
+	Contents       []fakeS3Object
+	CommonPrefixes []struct{ Prefix string }
+}
+
+type fakeS3Object struct {
+	Key          string
+	LastModified string
+	Size         int64
+	ETag         string
+}
+
+var fakeS3Time = time.Date(2024, 7, 20, 12, 0, 0, 0, time.UTC)
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", fakeS3Time.Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start:])
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	result := fakeS3ListResult{Name: f.bucket, Prefix: prefix, Delimiter: delimiter}
+	seen := map[string]bool{}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			common := prefix + rest[:i+1]
+			if !seen[common] {
+				seen[common] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{common})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Object{
+			Key:          key,
+			LastModified: fakeS3Time.Format(time.RFC3339),
+			Size:         int64(len(f.objects[key])),
+			ETag:         `"etag"`,
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Download(t *testing.T) {
+	store := &fakeS3{bucket: "pickup", objects: map[string][]byte{
+		"incoming/a.csv":          []byte("a,b\n"),
+		"incoming/2024/07/b.csv":  []byte("c,d\n"),
+		"incoming/2024/07/c.tmp":  []byte("partial"),
+		"incoming/2024/07/08/d.x": []byte("too deep"),
+	}}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	conn := Connection{
+		Name:      "s3_test",
+		Protocol:  "s3",
+		Endpoint:  server.URL,
+		Bucket:    "pickup",
+		Region:    "us-east-1",
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+		Path:      "incoming",
+		Depth:     3,
+		Regex:     "\\.csv$",
+		Remove:    true,
+	}
+	if err := validateS3(conn); err != nil {
+		t.Fatalf("validateS3 failed: %v", err)
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerS3{})
+
+	for name, want := range map[string]string{"a.csv": "a,b\n", "2024/07/b.csv": "c,d\n"} {
+		data, err := os.ReadFile(filepath.Join(download_folder, name))
+		if err != nil || string(data) != want {
+			t.Errorf("Unexpected content for %s: %q (err: %v)", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(download_folder, "2024/07/08/d.x")); !os.IsNotExist(err) {
+		t.Errorf("Expected objects below depth to be skipped")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.objects["incoming/a.csv"]; ok {
+		t.Errorf("Expected downloaded object to be removed")
+	}
+	if _, ok := store.objects["incoming/2024/07/c.tmp"]; !ok {
+		t.Errorf("Expected unmatched object to be kept")
+	}
+
+	entries, err := searchDownloadedFileEntries(db.conn, "b.csv", 4, "s3_test")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected b.csv to be recorded, got %v (err: %v)", entries, err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// defaultSegments is the number of byte ranges when segments is not set.
+	defaultSegments = 4
+	maxSegments     = 32
+
+	// segmentChunk is the size of a single read of a segment.
+	segmentChunk = 256 << 10
+	// segmentCheckpoint is how much a segment advances between saves of its
+	// resume state.
+	segmentCheckpoint = 8 << 20
+)
+
+// remoteFileAt is a remote file that can be read at any offset, from
+// several goroutines at once.
+type remoteFileAt interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// rangeReader is implemented by backends that support segmented downloads.
+type rangeReader interface {
+	openFileAt(remotePath string) (remoteFileAt, error)
+}
+
+// segmentState is the byte range [Start, End) of a segmented download, of
+// which the first Done bytes are on disk.
+type segmentState struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func validateSegments(conn Connection) error {
+	if conn.SegmentThreshold < 0 {
+		return fmt.Errorf("invalid segment_threshold for %s: %d", conn.Name, conn.SegmentThreshold)
+	}
+	if conn.Segments < 0 || conn.Segments > maxSegments {
+		return fmt.Errorf("invalid segments for %s: %d (maximum %d)", conn.Name, conn.Segments, maxSegments)
+	}
+	return nil
+}
+
+// useSegments reports whether file is large enough for a segmented download.
+func useSegments(conn Connection, file RemoteEntry) bool {
+	return conn.SegmentThreshold > 0 && file.Size >= conn.SegmentThreshold && file.Size > 0
+}
+
+// planSegments splits size bytes into n ranges of nearly equal length.
+func planSegments(size int64, n int) []segmentState {
+	if int64(n) > size {
+		n = int(size)
+	}
+	segments := make([]segmentState, n)
+	for i := range segments {
+		segments[i].Start = size * int64(i) / int64(n)
+		segments[i].End = size * int64(i+1) / int64(n)
+	}
+	return segments
+}
+
+// segmentedDownload fetches the byte ranges of the remote file concurrently
+// into a preallocated partPath. Progress of every range is kept in the
+// metadata sidecar, so an interrupted download only fetches what is missing.
+func segmentedDownload(rr rangeReader, conn Connection, file RemoteEntry, remoteFilePath, partPath, metaPath string, meta partMeta) error {
+	previous, ok := matchingPartMeta(partPath, metaPath, meta)
+	info, err := os.Stat(partPath)
+	if ok && len(previous.Segments) > 0 && err == nil && info.Size() == file.Size {
+		meta.Segments = previous.Segments
+		logger.Infof("Resuming segmented download of %s\n", remoteFilePath)
+	} else {
+		n := conn.Segments
+		if n == 0 {
+			n = defaultSegments
+		}
+		meta.Segments = planSegments(file.Size, n)
+		if err := writePartMeta(metaPath, meta); err != nil {
+			return fmt.Errorf("error writing partial file metadata: %v", err)
+		}
+		f, err := os.Create(partPath)
+		if err == nil {
+			err = f.Truncate(file.Size)
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("error creating destination file: %v", err)
+		}
+	}
+
+	dstFile, err := os.OpenFile(partPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening destination file: %v", err)
+	}
+	defer dstFile.Close()
+
+	// mu guards meta.Segments and the writes of the metadata sidecar
+	var mu sync.Mutex
+	checkpoint := func() error {
+		if err := dstFile.Sync(); err != nil {
+			return err
+		}
+		return writePartMeta(metaPath, meta)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(meta.Segments))
+	for i := range meta.Segments {
+		wg.Add(1)
+		go func(seg *segmentState) {
+			defer wg.Done()
+			errs <- fetchSegment(rr, conn, remoteFilePath, dstFile, seg, &mu, checkpoint)
+		}(&meta.Segments[i])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			mu.Lock()
+			checkpoint()
+			mu.Unlock()
+			return fmt.Errorf("error copying file: %v", err)
+		}
+	}
+	if err := dstFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing destination file: %v", err)
+	}
+	if err := dstFile.Close(); err != nil {
+		return fmt.Errorf("error closing destination file: %v", err)
+	}
+	return nil
+}
+
+// fetchSegment copies the missing part of seg with its own handle on the
+// remote file, saving progress every segmentCheckpoint bytes.
+func fetchSegment(rr rangeReader, conn Connection, remoteFilePath string, dst *os.File, seg *segmentState, mu *sync.Mutex, checkpoint func() error) error {
+	mu.Lock()
+	offset := seg.Start + seg.Done
+	mu.Unlock()
+	if offset >= seg.End {
+		return nil
+	}
+
+	src, err := rr.openFileAt(remoteFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	limiters := transferLimiters(conn)
+	buf := make([]byte, segmentChunk)
+	var sinceCheckpoint int64
+	for offset < seg.End {
+		n := int64(len(buf))
+		if remaining := seg.End - offset; remaining < n {
+			n = remaining
+		}
+		read, err := src.ReadAt(buf[:n], offset)
+		for _, l := range limiters {
+			l.wait(read)
+		}
+		if read > 0 {
+			if _, err := dst.WriteAt(buf[:read], offset); err != nil {
+				return err
+			}
+			offset += int64(read)
+			sinceCheckpoint += int64(read)
+
+			mu.Lock()
+			seg.Done = offset - seg.Start
+			if sinceCheckpoint >= segmentCheckpoint {
+				sinceCheckpoint = 0
+				if err := checkpoint(); err != nil {
+					logger.Debugf("Error saving segment progress: %v\n", err)
+				}
+			}
+			mu.Unlock()
+		}
+		if err == io.EOF && offset < seg.End {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// rangeManager serves fakeManager files to segmented downloads and counts
+// the bytes read through ReadAt.
+type rangeManager struct {
+	fakeManager
+	mu   sync.Mutex
+	read int64
+}
+
+type countingReaderAt struct {
+	r  *bytes.Reader
+	fm *rangeManager
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.fm.mu.Lock()
+	c.fm.read += int64(n)
+	c.fm.mu.Unlock()
+	return n, err
+}
+
+func (c *countingReaderAt) Close() error { return nil }
+
+func (fm *rangeManager) openFileAt(remotePath string) (remoteFileAt, error) {
+	data, ok := fm.files[remotePath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &countingReaderAt{r: bytes.NewReader(data), fm: fm}, nil
+}
+
+func TestSegmentedSFTPDownload(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, 3<<20+17)
+	rand.Read(content)
+	if err := os.WriteFile(filepath.Join(root, "large.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	srv := newTestSSHServer(t, root)
+	srv.start(t)
+
+	conn := Connection{Name: "segments", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass", SegmentThreshold: 1 << 20, Segments: 4}
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer fm.close()
+
+	local := filepath.Join(t.TempDir(), "large.bin")
+	file := RemoteEntry{Name: "large.bin", Size: int64(len(content))}
+	if _, err := resumableDownload(fm, conn, file, "large.bin", local); err != nil {
+		t.Fatalf("resumableDownload failed: %v", err)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Downloaded content differs from the remote file (err: %v)", err)
+	}
+	if _, err := os.Stat(local + partMetaSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected segment state to be removed after the download")
+	}
+}
+
+func TestSegmentedDownloadResumesMissingRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	fm := &rangeManager{fakeManager: fakeManager{files: map[string][]byte{"/big.bin": content}}}
+	conn := Connection{Name: "segments", SegmentThreshold: 1, Segments: 4}
+	file := RemoteEntry{Name: "big.bin", Size: int64(len(content))}
+	local := filepath.Join(t.TempDir(), "big.bin")
+
+	// An earlier attempt finished the first range and half of the second;
+	// their bytes are marked so the test can tell they were kept
+	meta := newPartMeta(conn, file, "/big.bin")
+	meta.Segments = planSegments(file.Size, 4)
+	meta.Segments[0].Done = meta.Segments[0].End - meta.Segments[0].Start
+	meta.Segments[1].Done = 125
+	part := bytes.Repeat([]byte{0}, len(content))
+	copy(part, bytes.Repeat([]byte("X"), 375))
+	if err := os.WriteFile(local+partSuffix, part, 0644); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+	if err := writePartMeta(local+partMetaSuffix, meta); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	if _, err := resumableDownload(fm, conn, file, "/big.bin", local); err != nil {
+		t.Fatalf("resumableDownload failed: %v", err)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatalf("Failed to read download: %v", err)
+	}
+	want := append(bytes.Repeat([]byte("X"), 375), content[375:]...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("Expected finished ranges to be kept and the rest fetched")
+	}
+	if fm.read != int64(len(content)-375) {
+		t.Errorf("Expected only %d missing bytes to be read, got %d", len(content)-375, fm.read)
+	}
+}
+
+func TestPlanSegments(t *testing.T) {
+	segments := planSegments(10, 3)
+	if len(segments) != 3 || segments[0].Start != 0 || segments[2].End != 10 {
+		t.Fatalf("Unexpected segments: %+v", segments)
+	}
+	for i := 1; i < len(segments); i++ {
+		if segments[i].Start != segments[i-1].End {
+			t.Errorf("Segments %d and %d are not contiguous: %+v", i-1, i, segments)
+		}
+	}
+	if got := planSegments(2, 4); len(got) != 2 {
+		t.Errorf("Expected no more segments than bytes, got %+v", got)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH authentication methods accepted in the auth_methods field.
+const (
+	authAgent               = "agent"
+	authPublicKey           = "publickey"
+	authKeyboardInteractive = "keyboard-interactive"
+	authPassword            = "password"
+)
+
+// validateSSH checks the host key and authentication options of connections
+// that use SSH.
+func validateSSH(conn Connection) error {
+	if err := validateServer(conn); err != nil {
+		return err
+	}
+	if err := validateHostKey(conn); err != nil {
+		return err
+	}
+	if conn.SSHCertPath != "" && conn.SSHKeyPath == "" {
+		return fmt.Errorf("sshcertpath requires sshkeypath for %s", conn.Name)
+	}
+	for _, method := range conn.AuthMethods {
+		switch method {
+		case authAgent:
+		case authPublicKey:
+			if conn.SSHKeyPath == "" {
+				return fmt.Errorf("auth method publickey requires sshkeypath for %s", conn.Name)
+			}
+		case authKeyboardInteractive, authPassword:
+			if conn.Password == "" {
+				return fmt.Errorf("auth method %s requires a password for %s", method, conn.Name)
+			}
+		default:
+			return fmt.Errorf("invalid auth method for %s: %s", conn.Name, method)
+		}
+	}
+	if len(sshAuthMethods(conn)) == 0 {
+		return fmt.Errorf("no authentication method configured for %s", conn.Name)
+	}
+	for _, hop := range jumpHosts(conn) {
+		if len(hop.Jump) > 0 {
+			return fmt.Errorf("nested jump hosts are not supported for %s", hop.Name)
+		}
+		if err := validateProxy(hop.Name, hop.Proxy); err != nil {
+			return err
+		}
+		if err := validateSSH(hop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sshAuthMethods returns the authentication methods to try, in order. Without
+// an explicit auth_methods list the agent, the private key and finally the
+// password are tried, each only when configured.
+func sshAuthMethods(conn Connection) []string {
+	if len(conn.AuthMethods) > 0 {
+		return conn.AuthMethods
+	}
+	var methods []string
+	if conn.SSHAgent {
+		methods = append(methods, authAgent)
+	}
+	if conn.SSHKeyPath != "" {
+		methods = append(methods, authPublicKey)
+	}
+	if conn.Password != "" {
+		// Servers that disable plain passwords often still accept the same
+		// password through keyboard-interactive
+		methods = append(methods, authPassword, authKeyboardInteractive)
+	}
+	return methods
+}
+
+// sshClientConfig builds the client configuration shared by every SSH based
+// backend. The returned release function must be called once the handshake
+// is done to close the connection to the SSH agent.
+func sshClientConfig(conn Connection) (*ssh.ClientConfig, func(), error) {
+	release := func() {}
+
+	hostKeyCallback, err := hostKeyCallback(conn)
+	if err != nil {
+		return nil, release, err
+	}
+
+	var auth []ssh.AuthMethod
+	for _, method := range sshAuthMethods(conn) {
+		switch method {
+		case authAgent:
+			agentConn, err := dialSSHAgent()
+			if err != nil {
+				// Fall through to the remaining methods
+				logger.Warnf("SSH agent is not available for %s: %v\n", conn.Name, err)
+				continue
+			}
+			release = func() { agentConn.Close() }
+			logger.Debugf("Using SSH agent for authentication: %s\n", conn.Username)
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		case authPublicKey:
+			signers, err := loadSSHSigners(conn)
+			if err != nil {
+				release()
+				return nil, func() {}, err
+			}
+			logger.Infof("Using SSH key for authentication: %s\n", conn.SSHKeyPath)
+			auth = append(auth, ssh.PublicKeys(signers...))
+		case authPassword:
+			logger.Debugf("Using password for authentication: %s\n", conn.Username)
+			auth = append(auth, ssh.Password(conn.Password))
+		case authKeyboardInteractive:
+			auth = append(auth, ssh.KeyboardInteractive(passwordChallenge(conn.Password)))
+		}
+	}
+	if len(auth) == 0 {
+		release()
+		return nil, func() {}, fmt.Errorf("no usable authentication method for %s", conn.Name)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            conn.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         5 * time.Second, // Add timeout of 5 seconds
+	}
+	return config, release, nil
+}
+
+// dialSSH connects and authenticates to the SSH server of conn, going
+// through each of its jump hosts in turn. Closing the returned client also
+// closes the connections to the jump hosts.
+func dialSSH(conn Connection) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+
+	var client *ssh.Client
+	for _, hop := range append(jumpHosts(conn), conn) {
+		next, err := dialSSHHop(client, hop)
+		if err != nil {
+			closeHops()
+			return nil, err
+		}
+		if client != nil {
+			hops = append(hops, client)
+		}
+		client = next
+	}
+
+	if len(hops) > 0 {
+		go func() {
+			client.Wait()
+			closeHops()
+		}()
+	}
+	return client, nil
+}
+
+// dialSSHHop connects to hop directly when via is nil, or through a
+// direct-tcpip channel of via otherwise.
+func dialSSHHop(via *ssh.Client, hop Connection) (*ssh.Client, error) {
+	config, release, err := sshClientConfig(hop)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	addr := hostPort(hop.Host, hop.Port)
+	var netConn net.Conn
+	if via == nil {
+		netConn, err = dialConnection(hop, addr, config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial SSH: %w", err)
+		}
+	} else {
+		logger.Debugf("Connecting to %s through jump host\n", addr)
+		netConn, err = via.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach %s through jump host: %v", addr, err)
+		}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to dial SSH: %w", err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// jumpHosts returns the jump hosts of conn, named after the connection so
+// that log messages and recorded host key errors can be traced back to it.
+func jumpHosts(conn Connection) []Connection {
+	hops := make([]Connection, len(conn.Jump))
+	for i, hop := range conn.Jump {
+		if hop.Name == "" {
+			hop.Name = fmt.Sprintf("%s jump %d", conn.Name, i+1)
+		}
+		if hop.Port == 0 {
+			hop.Port = 22
+		}
+		if hop.Proxy == "" {
+			hop.Proxy = conn.Proxy
+		}
+		hops[i] = hop
+	}
+	return hops
+}
+
+func dialSSHAgent() (net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", socket)
+}
+
+// loadSSHSigners reads the private key of conn, decrypting it with the
+// configured passphrase, and pairs it with the OpenSSH user certificate when
+// one is configured or found next to the key as <key>-cert.pub.
+func loadSSHSigners(conn Connection) ([]ssh.Signer, error) {
+	key, err := os.ReadFile(conn.SSHKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key file: %v", err)
+	}
+
+	var signer ssh.Signer
+	if conn.SSHKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(conn.SSHKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("SSH key %s is encrypted and sshkeypassphrase is not set", conn.SSHKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %v", err)
+	}
+
+	certPath := conn.SSHCertPath
+	if certPath == "" {
+		if _, err := os.Stat(conn.SSHKeyPath + "-cert.pub"); err == nil {
+			certPath = conn.SSHKeyPath + "-cert.pub"
+		}
+	}
+	if certPath == "" {
+		return []ssh.Signer{signer}, nil
+	}
+
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH certificate: %v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", certPath)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SSH certificate does not match key: %v", err)
+	}
+	logger.Debugf("Using SSH certificate for authentication: %s\n", certPath)
+
+	// Offer the certificate first and the bare key for servers without a CA
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// passwordChallenge answers keyboard-interactive prompts with the password.
+// Prompts that echo the answer ask for something else, such as a username,
+// and are answered with an empty string.
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] || strings.Contains(strings.ToLower(questions[i]), "password") {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestKey writes a new private key to dir, encrypted when passphrase is
+// set, and returns its path and signer.
+func writeTestKey(t *testing.T, dir, passphrase string) (string, ssh.Signer) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	return keyPath, signer
+}
+
+func TestSSHPassphraseProtectedKey(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	keyPath, signer := writeTestKey(t, t.TempDir(), "secret")
+	srv.config.PasswordCallback = nil
+	srv.config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+			return nil, nil
+		}
+		return nil, ssh.ErrNoAuth
+	}
+	srv.start(t)
+
+	conn := Connection{Name: "key", Host: "127.0.0.1", Port: srv.port(), Username: "user", SSHKeyPath: keyPath}
+	if _, err := dialSSH(conn); err == nil || !strings.Contains(err.Error(), "sshkeypassphrase") {
+		t.Fatalf("Expected missing passphrase error, got %v", err)
+	}
+
+	conn.SSHKeyPassphrase = "secret"
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("Failed to connect with passphrase protected key: %v", err)
+	}
+	fm.close()
+}
+
+func TestSSHUserCertificate(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	dir := t.TempDir()
+	keyPath, signer := writeTestKey(t, dir, "")
+
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caSigner, _ := ssh.NewSignerFromKey(caKey)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"user"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("Failed to sign certificate: %v", err)
+	}
+	// Picked up automatically from next to the key
+	if err := os.WriteFile(keyPath+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caSigner.PublicKey().Marshal())
+		},
+	}
+	srv.config.PasswordCallback = nil
+	srv.config.PublicKeyCallback = checker.Authenticate
+	srv.start(t)
+
+	conn := Connection{Name: "cert", Host: "127.0.0.1", Port: srv.port(), Username: "user", SSHKeyPath: keyPath}
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("Failed to connect with user certificate: %v", err)
+	}
+	fm.close()
+}
+
+func TestSSHKeyboardInteractiveFallback(t *testing.T) {
+	srv := newTestSSHServer(t, t.TempDir())
+	srv.config.PasswordCallback = nil
+	srv.config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) == 1 && answers[0] == "pass" {
+			return nil, nil
+		}
+		return nil, ssh.ErrNoAuth
+	}
+	srv.start(t)
+
+	conn := Connection{Name: "kbd", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass"}
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("Failed to connect with keyboard-interactive: %v", err)
+	}
+	fm.close()
+}
+
+func TestValidateSSHAuthMethods(t *testing.T) {
+	base := Connection{Name: "ssh", Host: "example.com", Port: 22, Username: "user"}
+
+	if err := validateSSH(base); err == nil {
+		t.Errorf("Expected error without any authentication method")
+	}
+
+	agentOnly := base
+	agentOnly.SSHAgent = true
+	if err := validateSSH(agentOnly); err != nil {
+		t.Errorf("Expected agent-only connection to be valid, got %v", err)
+	}
+
+	keyMethod := base
+	keyMethod.Password = "pass"
+	keyMethod.AuthMethods = []string{"publickey"}
+	if err := validateSSH(keyMethod); err == nil {
+		t.Errorf("Expected error for publickey without sshkeypath")
+	}
+
+	unknown := base
+	unknown.Password = "pass"
+	unknown.AuthMethods = []string{"gssapi"}
+	if err := validateSSH(unknown); err == nil {
+		t.Errorf("Expected error for unknown auth method")
+	}
+}
+
+func TestSSHJumpHost(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "behind.txt"), []byte("bastion"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	bastion := newTestSSHServer(t, t.TempDir())
+	bastion.start(t)
+	target := newTestSSHServer(t, root)
+	target.start(t)
+
+	conn := Connection{
+		Name: "jump", Host: "127.0.0.1", Port: target.port(), Username: "user", Password: "pass",
+		Jump: []Connection{{Host: "127.0.0.1", Port: bastion.port(), Username: "user", Password: "pass"}},
+	}
+	if err := validateSSH(conn); err != nil {
+		t.Fatalf("Expected valid jump host configuration, got %v", err)
+	}
+
+	fm := &ManagerSFTP{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("Failed to connect through jump host: %v", err)
+	}
+	defer fm.close()
+
+	entries, err := fm.readDir(".")
+	if err != nil || len(entries) != 1 || entries[0].Name != "behind.txt" {
+		t.Fatalf("Expected behind.txt through jump host, got %v (err: %v)", entries, err)
+	}
+	forwarded := bastion.forwardedTo()
+	if len(forwarded) != 1 || forwarded[0] != hostPort("127.0.0.1", target.port()) {
+		t.Errorf("Expected bastion to forward to the target, got %v", forwarded)
+	}
+}
+
+func TestFTPoverSSHTunnel(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "tunneled.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	ftpSrv := startTestFTPServer(t, root, nil, false)
+	sshSrv := newTestSSHServer(t, t.TempDir())
+	sshSrv.start(t)
+
+	conn := Connection{
+		Name: "tunnel", Host: "127.0.0.1", Port: sshSrv.port(), Protocol: "ftpoverssh",
+		Username: "user", Password: "pass",
+		FTPHost: "127.0.0.1", FTPPort: ftpSrv.port(), FTPUsername: "ftpuser", FTPPassword: "ftppass",
+	}
+	if err := validateFTPoverSSH(conn); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	fm := &ManagerFTPoverSSH{}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer fm.close()
+
+	rc, err := fm.openFile("/tunneled.txt", 0)
+	if err != nil {
+		t.Fatalf("openFile failed: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(data) != "inside" {
+		t.Errorf("Unexpected content %q (err: %v)", data, err)
+	}
+
+	// The control connection and the passive data connection both go
+	// through the SSH server
+	forwarded := sshSrv.forwardedTo()
+	if len(forwarded) < 2 || forwarded[0] != hostPort("127.0.0.1", ftpSrv.port()) {
+		t.Errorf("Expected control and data connections through SSH, got %v", forwarded)
+	}
+
+	// The FTP login uses the ftp_ credentials, not the SSH ones
+	if users := ftpSrv.args("USER"); len(users) == 0 || users[0] != "ftpuser" {
+		t.Errorf("Expected FTP login as ftpuser, got %v", users)
+	}
+	if passwords := ftpSrv.args("PASS"); len(passwords) == 0 || passwords[0] != "ftppass" {
+		t.Errorf("Expected FTP password ftppass, got %v", passwords)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is an in-process SSH server with the sftp subsystem, exec
+// requests run in root and direct-tcpip port forwarding.
+type testSSHServer struct {
+	root     string
+	hostKey  ssh.Signer
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu        sync.Mutex
+	forwarded []string
+}
+
+// newTestSSHServer returns a server that accepts user/pass password logins.
+// Tests can adjust config before calling start.
+func newTestSSHServer(t *testing.T, root string) *testSSHServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(signer)
+	return &testSSHServer{root: root, hostKey: signer, config: config}
+}
+
+func (srv *testSSHServer) start(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	// Keep trust-on-first-use writes out of the working directory
+	managedKnownHosts = filepath.Join(t.TempDir(), "known_hosts")
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(c)
+		}
+	}()
+}
+
+func (srv *testSSHServer) port() int {
+	return srv.listener.Addr().(*net.TCPAddr).Port
+}
+
+// forwardedTo returns the addresses clients asked to be forwarded to.
+func (srv *testSSHServer) forwardedTo() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.forwarded...)
+}
+
+func (srv *testSSHServer) serve(c net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(c, srv.config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go srv.session(newChannel)
+		case "direct-tcpip":
+			go srv.forward(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (srv *testSSHServer) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "subsystem":
+			if string(req.Payload[4:]) != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(srv.root))
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		case "exec":
+			req.Reply(true, nil)
+			cmd := exec.Command("sh", "-c", string(req.Payload[4:]))
+			cmd.Dir = srv.root
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			status := uint32(0)
+			if err := cmd.Run(); err != nil {
+				status = 1
+			}
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, status)
+			channel.SendRequest("exit-status", false, payload)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (srv *testSSHServer) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	srv.mu.Lock()
+	srv.forwarded = append(srv.forwarded, addr)
+	srv.mu.Unlock()
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	go func() {
+		io.Copy(target, channel)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(channel, target)
+	channel.Close()
+	target.Close()
+}
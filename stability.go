@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PendingFile is a remote file seen by a listing but not picked up yet
+// because it may still be growing. Listings counts the consecutive listings
+// that showed the same size and modification time since FirstSeen.
+type PendingFile struct {
+	ServerName string
+	FilePath   string
+	FileSize   int64
+	ModTime    string
+	FirstSeen  string
+	Listings   int
+}
+
+const pendingTimeFormat = "2006-01-02 15:04:05"
+
+func validateStability(conn Connection) error {
+	if conn.StableListings < 0 {
+		return fmt.Errorf("invalid stable_listings for %s: %d", conn.Name, conn.StableListings)
+	}
+	if conn.StableFor < 0 {
+		return fmt.Errorf("invalid stable_for for %s: %d", conn.Name, conn.StableFor)
+	}
+	if (conn.StableListings > 0 || conn.StableFor > 0) && conn.Direction == directionUpload {
+		return fmt.Errorf("stable_listings and stable_for are not supported for uploads: %s", conn.Name)
+	}
+	return nil
+}
+
+// fileIsStable records a listing of file and reports whether it has been
+// unchanged for long enough to be picked up. With stable_listings and
+// stable_for both set, both conditions must hold. Observations are kept in
+// the database so they carry over between passes and restarts.
+func fileIsStable(conn Connection, file RemoteEntry, remoteFilePath string, now time.Time) bool {
+	if conn.StableListings == 0 && conn.StableFor == 0 {
+		return true
+	}
+
+	db.mu.Lock()
+	pending, err := observePendingFile(db.conn, conn.Name, remoteFilePath, file.Size, file.ModTime.UTC().Format(time.RFC3339Nano), now)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error recording pending file: %v\n", err)
+		return false
+	}
+
+	if pending.Listings < conn.StableListings {
+		logger.Debugf("File %s unchanged for %d of %d listings, waiting\n", remoteFilePath, pending.Listings, conn.StableListings)
+		return false
+	}
+	firstSeen, err := time.ParseInLocation(pendingTimeFormat, pending.FirstSeen, time.Local)
+	if err != nil {
+		logger.Debugf("Error parsing pending file time: %v\n", err)
+		return false
+	}
+	if quiet := now.Sub(firstSeen); quiet < time.Duration(conn.StableFor)*time.Second {
+		logger.Debugf("File %s unchanged for %v of %ds, waiting\n", remoteFilePath, quiet.Truncate(time.Second), conn.StableFor)
+		return false
+	}
+	return true
+}
+
+// forgetPendingFile drops the observations of a file once it was picked up.
+func forgetPendingFile(conn Connection, remoteFilePath string) {
+	if conn.StableListings == 0 && conn.StableFor == 0 {
+		return
+	}
+	db.mu.Lock()
+	err := deletePendingFile(db.conn, conn.Name, remoteFilePath)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Debugf("Error deleting pending file: %v\n", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fixedTimeManager lists fakeManager files with a constant modification time
+// so that only size changes are visible between listings.
+type fixedTimeManager struct {
+	fakeManager
+}
+
+func (fm *fixedTimeManager) readDir(remotePath string) ([]RemoteEntry, error) {
+	entries, err := fm.fakeManager.readDir(remotePath)
+	for i := range entries {
+		entries[i].ModTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return entries, err
+}
+
+func TestFileIsStableListings(t *testing.T) {
+	setupTestDB(t)
+	conn := Connection{Name: "stable", StableListings: 2}
+	now := time.Now()
+	file := RemoteEntry{Name: "a.csv", Size: 10, ModTime: now}
+
+	if fileIsStable(conn, file, "/in/a.csv", now) {
+		t.Fatalf("Expected a file seen once to be pending")
+	}
+	// The partner is still writing: the count starts over
+	file.Size = 20
+	if fileIsStable(conn, file, "/in/a.csv", now) {
+		t.Fatalf("Expected a grown file to be pending")
+	}
+	if !fileIsStable(conn, file, "/in/a.csv", now) {
+		t.Fatalf("Expected a file unchanged for two listings to be stable")
+	}
+}
+
+func TestFileIsStableQuietPeriod(t *testing.T) {
+	setupTestDB(t)
+	conn := Connection{Name: "stable", StableFor: 60}
+	now := time.Now()
+	file := RemoteEntry{Name: "a.csv", Size: 10, ModTime: now}
+
+	if fileIsStable(conn, file, "/in/a.csv", now) {
+		t.Fatalf("Expected a new file to be pending")
+	}
+	if fileIsStable(conn, file, "/in/a.csv", now.Add(30*time.Second)) {
+		t.Fatalf("Expected a file quiet for 30s to be pending")
+	}
+	if !fileIsStable(conn, file, "/in/a.csv", now.Add(61*time.Second)) {
+		t.Fatalf("Expected a file quiet for 61s to be stable")
+	}
+}
+
+func TestDownloadWaitsForStableFiles(t *testing.T) {
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	fm := &fixedTimeManager{fakeManager{files: map[string][]byte{"/in/a.csv": []byte("partial")}}}
+	conn := Connection{Name: "stable", Path: "/in", Depth: 1, StableListings: 2}
+	local := filepath.Join(download_folder, "a.csv")
+
+	handleDownload(conn, fm)
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to wait for a second listing")
+	}
+
+	fm.files["/in/a.csv"] = []byte("partial and complete")
+	handleDownload(conn, fm)
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Fatalf("Expected a grown file to wait again")
+	}
+
+	handleDownload(conn, fm)
+	data, err := os.ReadFile(local)
+	if err != nil || string(data) != "partial and complete" {
+		t.Fatalf("Unexpected content %q (err: %v)", data, err)
+	}
+
+	var count int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM pending_files`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("Expected the pending entry to be removed after download, got %d (err: %v)", count, err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateWindow overrides the bandwidth limit between From and To, given as
+// HH:MM local time. Windows ending before they start span midnight.
+type RateWindow struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Limit string `yaml:"limit"`
+}
+
+// rateSchedule is a parsed bandwidth limit in bytes per second; 0 means
+// unlimited.
+type rateSchedule struct {
+	base    int64
+	windows []rateWindow
+}
+
+type rateWindow struct {
+	from, to int // minutes since midnight
+	limit    int64
+}
+
+// throttleChunk bounds a single read so that waits stay short and
+// concurrent transfers share the bandwidth evenly.
+const throttleChunk = 32 << 10
+
+// globalLimiter caps the bandwidth of all connections together.
+var globalLimiter *rateLimiter
+
+// connectionLimiters holds the limiter of every connection by name, shared
+// by its workers, segments and relays.
+var connectionLimiters = struct {
+	sync.Mutex
+	byName map[string]*rateLimiter
+}{byName: make(map[string]*rateLimiter)}
+
+// parseRate parses a bandwidth such as "2MB", "512 KB/s" or "1048576" into
+// bytes per second. Units are powers of 1024. Empty and "unlimited" are 0.
+func parseRate(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSpace(strings.TrimSuffix(s, "/S"))
+	if s == "" || s == "UNLIMITED" {
+		return 0, nil
+	}
+	number := strings.TrimRight(s, "KMGIB ")
+	unit := strings.TrimSpace(s[len(number):])
+	multiplier := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+		"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+		"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	}[unit]
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || multiplier == 0 || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func newRateSchedule(limit string, windows []RateWindow) (rateSchedule, error) {
+	base, err := parseRate(limit)
+	if err != nil {
+		return rateSchedule{}, err
+	}
+	schedule := rateSchedule{base: base}
+	for _, w := range windows {
+		from, err := parseClock(w.From)
+		if err != nil {
+			return rateSchedule{}, err
+		}
+		to, err := parseClock(w.To)
+		if err != nil {
+			return rateSchedule{}, err
+		}
+		limit, err := parseRate(w.Limit)
+		if err != nil {
+			return rateSchedule{}, err
+		}
+		schedule.windows = append(schedule.windows, rateWindow{from: from, to: to, limit: limit})
+	}
+	return schedule, nil
+}
+
+// at returns the limit in effect at t. The first matching window wins.
+func (s rateSchedule) at(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.from <= w.to && minute >= w.from && minute < w.to ||
+			w.from > w.to && (minute >= w.from || minute < w.to) {
+			return w.limit
+		}
+	}
+	return s.base
+}
+
+func (s rateSchedule) unlimited() bool {
+	if s.base > 0 {
+		return false
+	}
+	for _, w := range s.windows {
+		if w.limit > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validateRateLimit checks the bandwidth settings of a connection or of the
+// whole configuration.
+func validateRateLimit(name, limit string, windows []RateWindow) error {
+	if _, err := newRateSchedule(limit, windows); err != nil {
+		return fmt.Errorf("invalid rate limit for %s: %v", name, err)
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket holding up to one second of bandwidth.
+// Readers take tokens for what they have read and sleep off any debt.
+type rateLimiter struct {
+	schedule rateSchedule
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// Replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimiter(schedule rateSchedule) *rateLimiter {
+	return &rateLimiter{schedule: schedule, now: time.Now, sleep: time.Sleep}
+}
+
+// wait accounts for n bytes and blocks until they fit into the limit.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	rate := float64(l.schedule.at(now))
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return
+	}
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// setGlobalRateLimit installs the bandwidth cap shared by all connections.
+func setGlobalRateLimit(config Config) error {
+	schedule, err := newRateSchedule(config.RateLimit, config.RateSchedule)
+	if err != nil {
+		return err
+	}
+	globalLimiter = nil
+	if !schedule.unlimited() {
+		globalLimiter = newRateLimiter(schedule)
+	}
+	return nil
+}
+
+// transferLimiters returns the limiters a transfer of conn is subject to.
+func transferLimiters(conn Connection) []*rateLimiter {
+	var limiters []*rateLimiter
+	connectionLimiters.Lock()
+	l, ok := connectionLimiters.byName[conn.Name]
+	if !ok {
+		// Settings were checked by readConfig
+		schedule, _ := newRateSchedule(conn.RateLimit, conn.RateSchedule)
+		if !schedule.unlimited() {
+			l = newRateLimiter(schedule)
+		}
+		connectionLimiters.byName[conn.Name] = l
+	}
+	connectionLimiters.Unlock()
+	if l != nil {
+		limiters = append(limiters, l)
+	}
+	if globalLimiter != nil {
+		limiters = append(limiters, globalLimiter)
+	}
+	return limiters
+}
+
+// throttle limits reads from r to the bandwidth allowed for conn.
+func throttle(conn Connection, r io.Reader) io.Reader {
+	limiters := transferLimiters(conn)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{r: r, limiters: limiters}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
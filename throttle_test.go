@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for input, want := range map[string]int64{
+		"":          0,
+		"unlimited": 0,
+		"0":         0,
+		"1000":      1000,
+		"512KB":     512 << 10,
+		"2 MB/s":    2 << 20,
+		"1.5M":      3 << 19,
+		"1GiB":      1 << 30,
+	} {
+		got, err := parseRate(input)
+		if err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"fast", "2XB", "-1MB"} {
+		if _, err := parseRate(input); err == nil {
+			t.Errorf("Expected parseRate(%q) to fail", input)
+		}
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	schedule, err := newRateSchedule("", []RateWindow{
+		{From: "08:00", To: "18:00", Limit: "2MB"},
+		{From: "22:00", To: "02:00", Limit: "100KB"},
+	})
+	if err != nil {
+		t.Fatalf("newRateSchedule failed: %v", err)
+	}
+	at := func(clock string) time.Time {
+		tm, _ := time.Parse("15:04", clock)
+		return tm
+	}
+	for clock, want := range map[string]int64{
+		"07:59": 0,
+		"08:00": 2 << 20,
+		"17:59": 2 << 20,
+		"18:00": 0,
+		"23:30": 100 << 10,
+		"01:00": 100 << 10,
+		"02:00": 0,
+	} {
+		if got := schedule.at(at(clock)); got != want {
+			t.Errorf("Limit at %s = %d, want %d", clock, got, want)
+		}
+	}
+
+	if err := validateRateLimit("test", "1MB", []RateWindow{{From: "8", To: "18:00", Limit: "1MB"}}); err == nil {
+		t.Errorf("Expected an invalid window time to be rejected")
+	}
+}
+
+func TestRateLimiterThrottlesReads(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	limiter := newRateLimiter(rateSchedule{base: 100 << 10})
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// One second of bandwidth is available at once, the remaining three
+	// seconds worth have to be waited for
+	content := bytes.Repeat([]byte("x"), 400<<10)
+	r := &throttledReader{r: bytes.NewReader(content), limiters: []*rateLimiter{limiter}}
+	data, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Unexpected throttled content (err: %v)", err)
+	}
+	if slept < 2900*time.Millisecond || slept > 3100*time.Millisecond {
+		t.Errorf("Expected about 3s of throttling, got %v", slept)
+	}
+}
+
+func TestThrottleUnlimited(t *testing.T) {
+	r := bytes.NewReader(nil)
+	if got := throttle(Connection{Name: "unlimited"}, r); got != io.Reader(r) {
+		t.Errorf("Expected an unlimited connection to read directly")
+	}
+}
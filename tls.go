@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validateTLS checks the TLS options of a connection without loading any files.
+func validateTLS(conn Connection) error {
+	if (conn.TLSCertFile == "") != (conn.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together for %s", conn.Name)
+	}
+	if conn.TLSMinVersion != "" {
+		if _, ok := tlsVersions[conn.TLSMinVersion]; !ok {
+			return fmt.Errorf("invalid tls_min_version for %s: %s", conn.Name, conn.TLSMinVersion)
+		}
+	}
+	return nil
+}
+
+// buildTLSConfig creates the client TLS configuration for a connection from
+// its CA bundle, client certificate, server name and minimum version options.
+func buildTLSConfig(conn Connection) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: conn.Host,
+		MinVersion: tls.VersionTLS12,
+		// FTP servers commonly require the data connection to resume the
+		// TLS session of the control connection.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if conn.TLSServerName != "" {
+		config.ServerName = conn.TLSServerName
+	}
+
+	if conn.TLSMinVersion != "" {
+		version, ok := tlsVersions[conn.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS version: %s", conn.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if conn.TLSCAFile != "" {
+		caData, err := os.ReadFile(conn.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in CA bundle: %s", conn.TLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if conn.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conn.TLSCertFile, conn.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
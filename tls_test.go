@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 and
+// returns it together with the path of its PEM encoding.
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftransfer test"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	certPath := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPath
+}
+
+func TestFTPSDownload(t *testing.T) {
+	cert, caFile := newTestCertificate(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	for _, tc := range []struct {
+		protocol string
+		implicit bool
+	}{
+		{"ftps", false},
+		{"ftps-implicit", true},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(root, "report.csv"), []byte("id,value\n1,2\n"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			srv := startTestFTPServer(t, root, serverTLS, tc.implicit)
+
+			conn := Connection{
+				Name:      "ftps_test",
+				Host:      "127.0.0.1",
+				Port:      srv.port(),
+				Protocol:  tc.protocol,
+				Username:  "user",
+				Password:  "pass",
+				TLSCAFile: caFile,
+			}
+			backend, ok := lookupBackend(tc.protocol)
+			if !ok {
+				t.Fatalf("Protocol %s is not registered", tc.protocol)
+			}
+			if err := backend.Validate(conn); err != nil {
+				t.Fatalf("Validate failed: %v", err)
+			}
+
+			fm := backend.New()
+			if err := fm.connect(conn); err != nil {
+				t.Fatalf("connect failed: %v", err)
+			}
+			defer fm.close()
+
+			entries, err := fm.readDir("/")
+			if err != nil {
+				t.Fatalf("readDir failed: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name != "report.csv" || entries[0].Kind != EntryFile {
+				t.Fatalf("Unexpected entries: %+v", entries)
+			}
+
+			rc, err := fm.openFile("/report.csv", 0)
+			if err != nil {
+				t.Fatalf("openFile failed: %v", err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != "id,value\n1,2\n" {
+				t.Errorf("Unexpected content %q (err: %v)", data, err)
+			}
+			if !tc.implicit && !srv.received("AUTH") {
+				t.Errorf("Expected AUTH TLS to be sent for explicit FTPS")
+			}
+		})
+	}
+}
+
+func TestFTPSRejectsUntrustedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	srv := startTestFTPServer(t, t.TempDir(), &tls.Config{Certificates: []tls.Certificate{cert}}, false)
+
+	fm := &ManagerFTP{tlsMode: ftpTLSExplicit}
+	err := fm.connect(Connection{Name: "untrusted", Host: "127.0.0.1", Port: srv.port(), Username: "user", Password: "pass"})
+	if err == nil {
+		fm.close()
+		t.Fatalf("Expected connection with an untrusted certificate to fail")
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	if err := validateTLS(Connection{Name: "c", TLSCertFile: "client.pem"}); err == nil {
+		t.Errorf("Expected error for certificate without key")
+	}
+	if err := validateTLS(Connection{Name: "c", TLSMinVersion: "1.4"}); err == nil {
+		t.Errorf("Expected error for unknown TLS version")
+	}
+	if err := validateTLS(Connection{Name: "c", TLSMinVersion: "1.3"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// handleUpload connects fm using conn and delivers matching files from
+// conn.LocalPath into conn.Path on the remote server.
+func handleUpload(conn Connection, fm Manager) {
+	up, ok := fm.(uploader)
+	if !ok {
+		logger.Errorf("Protocol %s does not support uploads: %s\n", conn.Protocol, conn.Name)
+		return
+	}
+
+	if _, err := os.Stat(conn.LocalPath); err != nil {
+		logger.Debugf("Error accessing local source folder: %v\n", err)
+		return
+	}
+
+	// Attempt to connect to the server
+	err := connectManager(fm, conn)
+	if err != nil {
+		logger.Debugf("Error connecting to %s: %v\n", conn.Protocol, err)
+		return
+	}
+	defer fm.close()
+
+	err = recursivelyUpload(conn.LocalPath, conn.Path, conn.Depth, up, conn, newFileFilter(conn, time.Now()))
+	if err != nil {
+		logger.Debugf("Error uploading files: %v\n", err)
+	}
+}
+
+func recursivelyUpload(localPath, remotePath string, depth int, fm uploader, conn Connection, filter *fileFilter) error {
+	if depth == 0 {
+		return nil
+	}
+
+	files, err := os.ReadDir(localPath)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %v", err)
+	}
+
+	for _, file := range files {
+		localFilePath := filepath.Join(localPath, file.Name())
+		remoteFilePath := path.Join(remotePath, file.Name())
+
+		info, err := os.Stat(localFilePath)
+		if err != nil {
+			logger.Debugf("Error getting file info: %v\n", err)
+			continue
+		}
+
+		if info.IsDir() {
+			if !filter.matchFolder(info.Name(), localFilePath) {
+				continue
+			}
+			// Remote folders are created on demand when a file is uploaded
+			err := recursivelyUpload(localFilePath, remoteFilePath, depth-1, fm, conn, filter)
+			if err != nil {
+				logger.Debugf("Error uploading directory: %v\n", err)
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		relPath, err := filepath.Rel(conn.LocalPath, localFilePath)
+		if err != nil {
+			logger.Debugf("Error getting relative path: %v\n", err)
+			continue
+		}
+		entry := RemoteEntry{Name: info.Name(), Kind: EntryFile, Size: info.Size(), ModTime: info.ModTime()}
+		if filter.matchFile(entry, filepath.ToSlash(relPath)) {
+			uploadEntry(info, localFilePath, remoteFilePath, fm, conn)
+		}
+	}
+	return nil
+}
+
+// uploadEntry delivers a single local file, verifies the remote size, applies
+// the local remove or archive policy and records the transfer.
+func uploadEntry(info os.FileInfo, localFilePath, remoteFilePath string, fm uploader, conn Connection) {
+	// Check if the file has already been uploaded
+	db.mu.Lock()
+	existingFiles, err := searchTransferEntries(db.conn, info.Name(), info.Size(), conn.Name, directionUpload)
+	db.mu.Unlock()
+
+	if err != nil {
+		logger.Debugf("Error searching for existing file entries: %v\n", err)
+		return
+	}
+
+	if len(existingFiles) > 0 {
+		logger.Warnf("File already uploaded: %s\n", info.Name())
+		return
+	}
+
+	if err := fm.makeDir(path.Dir(remoteFilePath)); err != nil {
+		logger.Debugf("Error creating remote directory: %v\n", err)
+		return
+	}
+
+	srcFile, err := os.Open(localFilePath)
+	if err != nil {
+		logger.Debugf("Error opening local file: %v\n", err)
+		return
+	}
+
+	startTime := time.Now()
+	err = fm.writeFile(remoteFilePath, throttle(conn, srcFile))
+	srcFile.Close()
+	if err != nil {
+		logger.Debugf("Error uploading file: %v\n", err)
+		return
+	}
+	logger.Infof("Uploaded file: %s (Size: %s) in %v\n", info.Name(), bytesToHumanReadable(info.Size()), time.Since(startTime))
+
+	// Verify the remote size to ensure the upload was successful
+	remoteInfo, err := fm.stat(remoteFilePath)
+	if err != nil {
+		logger.Debugf("Error getting remote file info: %v\n", err)
+		return
+	}
+
+	if remoteInfo.Size != info.Size() {
+		logger.Debugf("File size mismatch for %s: local size %d, remote size %d\n", info.Name(), info.Size(), remoteInfo.Size)
+		// If the file sizes do not match, delete the incomplete remote file
+		if err := fm.deleteFile(remoteFilePath); err != nil {
+			logger.Debugf("Error deleting invalid remote file: %v\n", err)
+		}
+		return
+	}
+
+	switch {
+	case conn.LocalArchive != "":
+		if err := archiveLocalFile(localFilePath, conn); err != nil {
+			logger.Errorf("Error archiving local file: %v\n", err)
+		}
+	case conn.Remove:
+		if err := os.Remove(localFilePath); err != nil {
+			logger.Errorf("Error deleting local file: %v\n", err)
+		} else {
+			logger.Debugf("Deleted local file: %s\n", localFilePath)
+		}
+	}
+
+	uploadedFile := DownloadedFile{
+		FileName:     info.Name(),
+		ServerName:   conn.Name,
+		FileSize:     info.Size(),
+		DownloadTime: time.Now().Format("2006-01-02 15:04:05"),
+		Direction:    directionUpload,
+	}
+
+	db.mu.Lock()
+	err = saveDownloadedFileEntry(db.conn, uploadedFile)
+	db.mu.Unlock()
+	if err != nil {
+		logger.Fatalf("Failed to save file entry: %v", err)
+	}
+}
+
+// archiveLocalFile moves an uploaded file below conn.LocalArchive, keeping its
+// path relative to conn.LocalPath.
+func archiveLocalFile(localFilePath string, conn Connection) error {
+	rel, err := filepath.Rel(conn.LocalPath, localFilePath)
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(conn.LocalArchive, rel)
+	if err := os.MkdirAll(filepath.Dir(archivePath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(localFilePath, archivePath); err != nil {
+		return err
+	}
+	logger.Debugf("Archived local file: %s -> %s\n", localFilePath, archivePath)
+	return nil
+}
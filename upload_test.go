@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadToFTP(t *testing.T) {
+	outbox := t.TempDir()
+	archive := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outbox, "daily"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for name, content := range map[string]string{
+		"orders.xml":      "<orders/>",
+		"daily/stock.xml": "<stock/>",
+		"daily/notes.tmp": "draft",
+	} {
+		if err := os.WriteFile(filepath.Join(outbox, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	remoteRoot := t.TempDir()
+	srv := startTestFTPServer(t, remoteRoot, nil, false)
+
+	conn := Connection{
+		Name:         "ftp_upload",
+		Host:         "127.0.0.1",
+		Port:         srv.port(),
+		Protocol:     "ftp",
+		Username:     "user",
+		Password:     "pass",
+		Path:         "/inbox",
+		Depth:        2,
+		Regex:        "\\.xml$",
+		Direction:    directionUpload,
+		LocalPath:    outbox,
+		LocalArchive: archive,
+	}
+
+	setupTestDB(t)
+	handleUpload(conn, &ManagerFTP{})
+
+	for name, want := range map[string]string{"inbox/orders.xml": "<orders/>", "inbox/daily/stock.xml": "<stock/>"} {
+		data, err := os.ReadFile(filepath.Join(remoteRoot, name))
+		if err != nil || string(data) != want {
+			t.Errorf("Unexpected remote content for %s: %q (err: %v)", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remoteRoot, "inbox/daily/notes.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected unmatched file not to be uploaded")
+	}
+	if _, err := os.Stat(filepath.Join(archive, "daily/stock.xml")); err != nil {
+		t.Errorf("Expected uploaded file to be archived: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outbox, "orders.xml")); !os.IsNotExist(err) {
+		t.Errorf("Expected uploaded file to be moved out of the outbox")
+	}
+
+	entries, err := searchTransferEntries(db.conn, "orders.xml", 9, "ftp_upload", directionUpload)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected upload to be recorded, got %v (err: %v)", entries, err)
+	}
+	entries, err = searchDownloadedFileEntries(db.conn, "orders.xml", 9, "ftp_upload")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected upload not to count as a download, got %v (err: %v)", entries, err)
+	}
+}
+
+func TestUploadSkipsNestedArchive(t *testing.T) {
+	outbox := t.TempDir()
+	remote := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outbox, "orders.xml"), []byte("<orders/>"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	conn := Connection{
+		Name: "local_upload", Protocol: "local", Path: remote, Depth: 2,
+		Direction: directionUpload, LocalPath: outbox, LocalArchive: filepath.Join(outbox, "sent"),
+	}
+
+	setupTestDB(t)
+	handleUpload(conn, &ManagerLocal{})
+	if _, err := os.Stat(filepath.Join(outbox, "sent", "orders.xml")); err != nil {
+		t.Fatalf("Expected the uploaded file to be archived: %v", err)
+	}
+
+	// The archive is inside the outbox but never walked, even when its
+	// files are not known from an earlier upload
+	setupTestDB(t)
+	handleUpload(conn, &ManagerLocal{})
+	if _, err := os.Stat(filepath.Join(remote, "sent")); !os.IsNotExist(err) {
+		t.Errorf("Expected archived files not to be uploaded again")
+	}
+}
+
+func TestReadConfigUploadValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		settings []string
+	}{
+		{"without local_path", nil},
+		{"with stable_for", []string{`local_path: "/tmp"`, `stable_for: 60`}},
+		{"with a marker", []string{`local_path: "/tmp"`, `marker: ".done"`}},
+		{"with post_action", []string{`local_path: "/tmp"`, `post_action: "delete"`}},
+	} {
+		yamlContent := `
+connections:
+  - name: "upload"
+    protocol: "local"
+    path: "/tmp"
+    direction: "upload"
+`
+		for _, setting := range tc.settings {
+			yamlContent += "    " + setting + "\n"
+		}
+		configPath := filepath.Join(t.TempDir(), "connections.yaml")
+		if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err := readConfig(configPath); err == nil {
+			t.Errorf("Expected error for upload %s", tc.name)
+		}
+	}
+}
+
+func TestFTPMakeDirReportsErrors(t *testing.T) {
+	remoteRoot := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(remoteRoot, "inbox"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(remoteRoot, "blocker"), []byte("file"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	srv := startTestFTPServer(t, remoteRoot, nil, false)
+
+	fm := &ManagerFTP{}
+	conn := Connection{Name: "ftp_mkdir", Host: "127.0.0.1", Port: srv.port(), Protocol: "ftp", Username: "user", Password: "pass"}
+	if err := fm.connect(conn); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer fm.close()
+
+	// Existing folders are accepted, missing ones created
+	if err := fm.makeDir("/inbox/daily"); err != nil {
+		t.Errorf("makeDir failed: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(remoteRoot, "inbox/daily")); err != nil || !info.IsDir() {
+		t.Errorf("Expected the folder to be created (err: %v)", err)
+	}
+	// A file in the way is not mistaken for an existing folder
+	if err := fm.makeDir("/blocker/sub"); err == nil {
+		t.Errorf("Expected makeDir to fail below a file")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAVDownload(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "docs", "2024"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	files := map[string]string{
+		"docs/contract.pdf":   "%PDF-1.4",
+		"docs/2024/index.xml": "<index/>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	dav := &webdav.Handler{
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "dav" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conn := Connection{
+		Name:     "webdav_test",
+		Protocol: "webdav",
+		Endpoint: server.URL,
+		Username: "dav",
+		Password: "secret",
+		Path:     "/docs",
+		Depth:    2,
+		Remove:   true,
+	}
+	if err := validateWebDAV(conn); err != nil {
+		t.Fatalf("validateWebDAV failed: %v", err)
+	}
+
+	setupTestDB(t)
+	download_folder = t.TempDir()
+	handleDownload(conn, &ManagerWebDAV{})
+
+	for name, want := range map[string]string{"contract.pdf": "%PDF-1.4", "2024/index.xml": "<index/>"} {
+		data, err := os.ReadFile(filepath.Join(download_folder, name))
+		if err != nil || string(data) != want {
+			t.Errorf("Unexpected content for %s: %q (err: %v)", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "docs/contract.pdf")); !os.IsNotExist(err) {
+		t.Errorf("Expected remote file to be deleted after download")
+	}
+
+	// Resume a partial local copy with a range request
+	if err := os.WriteFile(filepath.Join(root, "docs/large.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(root, "docs/large.bin"))
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	// WebDAV reports modification times with one second precision
+	file := RemoteEntry{Name: "large.bin", Size: 10, ModTime: info.ModTime().Truncate(time.Second)}
+	local := filepath.Join(download_folder, "large.bin")
+	if err := os.WriteFile(local+partSuffix, []byte("XXXX"), 0644); err != nil {
+		t.Fatalf("Failed to write partial file: %v", err)
+	}
+	if err := writePartMeta(local+partMetaSuffix, newPartMeta(conn, file, "/docs/large.bin")); err != nil {
+		t.Fatalf("Failed to write partial file metadata: %v", err)
+	}
+	handleDownload(conn, &ManagerWebDAV{})
+	data, err := os.ReadFile(local)
+	if err != nil || string(data) != "XXXX456789" {
+		t.Errorf("Unexpected resumed content %q (err: %v)", data, err)
+	}
+}